@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// TagActivity records the write activity of a database at the time of the
+// dump, used to skip dumps of databases that did not change
+const TagActivity = "tag:pg-activity"
+
+// databaseActivity returns a fingerprint of the write activity of db. It
+// changes with every inserted, updated or deleted row and when statistics are
+// reset, as well as with the dump settings that shape the snapshot.
+func databaseActivity(ctx context.Context, db config.Database) (string, error) {
+	output, err := pgCommand(ctx, db, "psql",
+		"--dbname", db.DBName,
+		"--tuples-only",
+		"--no-align",
+		"--command", "SELECT coalesce(stats_reset::text, '-') || ':' || (tup_inserted + tup_updated + tup_deleted) FROM pg_stat_database WHERE datname = current_database();",
+	).Output()
+	if err != nil {
+		return "", fmt.Errorf("querying database activity: %w", err)
+	}
+
+	counters := strings.TrimSpace(string(output))
+	if counters == "" {
+		return "", fmt.Errorf("no activity statistics for database %s", db.DBName)
+	}
+	return activityFingerprint(counters, db), nil
+}
+
+// activityFingerprint adds the dump settings of db to its activity counters.
+// Changing the format, mode or compression then dumps again instead of
+// reusing a snapshot in the old shape.
+func activityFingerprint(counters string, db config.Database) string {
+	fingerprint := fmt.Sprintf("%s schema=%s perTable=%t format=%s mode=%s", counters, dumpSchema(db), db.PerTable, dumpFormat(db), db.Mode)
+	if db.Compression != nil {
+		fingerprint += fmt.Sprintf(" compress=%d", *db.Compression)
+	}
+	if db.Policy != nil && db.Policy.Compression != "" {
+		fingerprint += fmt.Sprintf(" compression=%s", db.Policy.Compression)
+	}
+	if filter := filterArgs(db); len(filter) > 0 {
+		fingerprint += fmt.Sprintf(" filter=%q", filter)
+	}
+	return fingerprint
+}
+
+// reuseSnapshot records a new snapshot of src that shares the contents of
+// previous, so an unchanged database still gets a snapshot for this run. It
+// keeps the recorded tags of previous but gets the currently configured tags.
+func reuseSnapshot(ctx context.Context, r repo.Repository, previous *snapshot.Manifest, src snapshot.SourceInfo, configured map[string]string) (string, error) {
+	tags := snapshotTags(configured)
+	for _, key := range internalTags {
+		if value := snapshotTag(previous, key); value != "" {
+			tags[key] = value
+		}
+	}
+
+	var manifestID string
+	err := repo.WriteSession(ctx, r, repo.WriteSessionOptions{
+		Purpose: "Reuse database snapshot",
+	}, func(ctx context.Context, w repo.RepositoryWriter) error {
+		now := fs.UTCTimestampFromTime(time.Now())
+		manifest := &snapshot.Manifest{
+			Source:      src,
+			Description: previous.Description,
+			StartTime:   now,
+			EndTime:     now,
+			RootEntry:   previous.RootEntry,
+			Stats:       previous.Stats,
+			Tags:        tags,
+		}
+
+		id, err := snapshot.SaveSnapshot(ctx, w, manifest)
+		if err != nil {
+			return fmt.Errorf("saving snapshot: %w", err)
+		}
+		manifestID = string(id)
+		recordSnapshot(ctx, id, manifest.Stats)
+		return nil
+	})
+	return manifestID, err
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+)
+
+// runPostRestoreChecks runs the configured verification checks against a
+// restored database and fails on the first check that errors or returns
+// unexpected output
+func runPostRestoreChecks(ctx context.Context, db config.Database) error {
+	for i, check := range db.PostRestoreChecks {
+		name := check.SQL
+		if name == "" {
+			name = check.Command
+		}
+
+		var cmd *exec.Cmd
+		switch {
+		case check.SQL != "" && isMongoDB(db):
+			return fmt.Errorf("post-restore check %q: sql checks are not supported for MongoDB, use a command", name)
+		case check.SQL != "" && isRedis(db):
+			return fmt.Errorf("post-restore check %q: sql checks are not supported for Redis, use a command", name)
+		case check.SQL != "" && isSQLite(db):
+			cmd = newCommand(ctx, "sqlite3", "-bail", "-batch", db.Path, check.SQL)
+		case check.SQL != "" && isMySQL(db):
+			cmd = mysqlCommand(ctx, db, "mysql",
+				"--batch",
+				"--skip-column-names",
+				"--execute", check.SQL,
+				db.DBName,
+			)
+		case check.SQL != "":
+			cmd = pgCommand(ctx, db, "psql",
+				"--dbname", db.DBName,
+				"--set", "ON_ERROR_STOP=1",
+				"--tuples-only",
+				"--no-align",
+				"--command", check.SQL,
+			)
+		case check.Command != "":
+			cmd = newCommand(ctx, "sh", "-c", check.Command)
+			cmd.Env = commandEnv(db)
+		default:
+			return fmt.Errorf("post-restore check %d has neither sql nor command", i+1)
+		}
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("post-restore check %q failed: %w\nOutput: %s", name, err, string(output))
+		}
+		if check.Expect != "" && strings.TrimSpace(string(output)) != check.Expect {
+			return fmt.Errorf("post-restore check %q returned %q, expected %q", name, strings.TrimSpace(string(output)), check.Expect)
+		}
+		utils.Infof("Post-restore check passed: %s", name)
+	}
+	return nil
+}
+
+// commandEnv returns the environment for shell commands run against db. They
+// get the connection settings through the standard client variables.
+func commandEnv(db config.Database) []string {
+	if isMongoDB(db) || isSQLite(db) {
+		env := os.Environ()
+		for key, value := range db.Env {
+			env = append(env, fmt.Sprintf("%s=%s", key, value))
+		}
+		return env
+	}
+	if isRedis(db) {
+		return redisEnv(db)
+	}
+	if isMySQL(db) {
+		return append(mysqlEnv(db),
+			fmt.Sprintf("MYSQL_HOST=%s", db.Host),
+			fmt.Sprintf("MYSQL_TCP_PORT=%d", db.Port),
+		)
+	}
+	return append(pgEnv(db),
+		fmt.Sprintf("PGHOST=%s", db.Host),
+		fmt.Sprintf("PGPORT=%d", db.Port),
+		fmt.Sprintf("PGUSER=%s", db.User),
+		fmt.Sprintf("PGDATABASE=%s", db.DBName),
+	)
+}
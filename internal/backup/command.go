@@ -0,0 +1,22 @@
+package backup
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// commandWaitDelay is how long a canceled command may take to close its
+// output after it was killed
+const commandWaitDelay = 10 * time.Second
+
+// newCommand prepares a command that is killed together with the processes
+// it started when ctx is done, like the parallel workers of pg_dump --jobs or
+// the commands of a hook script. Wait returns even if a process that escaped
+// keeps the output open.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	killProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
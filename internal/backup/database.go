@@ -2,10 +2,13 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/avolut/backup/internal/config"
@@ -14,120 +17,254 @@ import (
 	"github.com/kopia/kopia/fs/localfs"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/snapshot"
-	"github.com/kopia/kopia/snapshot/policy"
 	"github.com/kopia/kopia/snapshot/snapshotfs"
 )
 
-func BackupDatabase(ctx context.Context, r repo.Repository, db config.Database) error {
-	// Set process priority to reduce CPU usage
-	if err := utils.SetProcessPriority(); err != nil {
-		fmt.Printf("Warning: failed to set process priority: %v\n", err)
+// BackupDatabase dumps db and uploads the dump as a snapshot. PostgreSQL
+// logical dumps go through dumper, pg_dump when nil.
+func BackupDatabase(ctx context.Context, r repo.Repository, db config.Database, dumper Dumper) error {
+	if dumper == nil {
+		dumper = pgDumper{}
 	}
 
-	// Check pg_dump version
-	pgDumpVersion, err := exec.Command("pg_dump", "--version").Output()
+	// Check the dump tool version
+	if err := validateMode(db); err != nil {
+		return err
+	}
+	dumpTool := "pg_dump"
+	var dumpVersion string
+	var err error
+	switch db.Engine {
+	case "", enginePostgres:
+		if isPhysical(db) {
+			dumpTool = "pg_basebackup"
+			dumpVersion, err = toolVersion(dumpTool)
+		} else {
+			dumpVersion, err = dumper.ToolVersion(ctx)
+		}
+	case engineMySQL, engineMongoDB, engineSQLite, engineRedis:
+		if db.PerTable || db.SkipUnchanged {
+			return fmt.Errorf("perTable and skipUnchanged are only supported for PostgreSQL")
+		}
+		switch {
+		case isMongoDB(db):
+			dumpTool = "mongodump"
+		case isSQLite(db):
+			dumpTool = "sqlite3"
+		case isRedis(db):
+			dumpTool = "redis-cli"
+		default:
+			dumpTool = "mysqldump"
+		}
+		dumpVersion, err = toolVersion(dumpTool)
+	default:
+		return fmt.Errorf("unknown database engine %q, use %s, %s, %s, %s or %s", db.Engine, enginePostgres, engineMySQL, engineMongoDB, engineSQLite, engineRedis)
+	}
 	if err != nil {
-		return fmt.Errorf("getting pg_dump version: %w", err)
+		return fmt.Errorf("getting dump tool version: %w", err)
+	}
+	if err := validateFormat(db); err != nil {
+		return err
 	}
 
-	// Get database version
-	dbVersionCmd := exec.Command("psql",
-		"--host", db.Host,
-		"--port", fmt.Sprintf("%d", db.Port),
-		"--username", db.User,
-		"--dbname", db.DBName,
-		"--tuples-only",
-		"--command", "SELECT version();",
-	)
-	dbVersionCmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", db.Password))
-	dbVersion, err := dbVersionCmd.Output()
+	// Get database version, waiting for the database to become ready.
+	// mongodump connects on its own and works across server versions, and a
+	// SQLite file has no server.
+	dbVersion := "unknown"
+	switch {
+	case isMongoDB(db), isSQLite(db):
+	case isMySQL(db), isRedis(db):
+		dbVersion, err = waitForDatabase(ctx, db)
+	default:
+		dbVersion, err = dumper.ServerVersion(ctx, db)
+	}
 	if err != nil {
-		return fmt.Errorf("getting database version: %w", err)
+		return err
 	}
 
-	// Extract major version numbers for comparison
-	pgDumpMajorVersion := extractMajorVersion(string(pgDumpVersion))
-	dbMajorVersion := extractMajorVersion(string(dbVersion))
+	// Make sure the dump tool can handle the server
+	dumpMajorVersion := serverMajorVersion(db, dumpVersion)
+	dbMajorVersion := serverMajorVersion(db, dbVersion)
+	if err := checkVersions(db, dumpTool, dumpMajorVersion, dbMajorVersion); err != nil {
+		return err
+	}
+	if err := checkParallelDump(db, dbMajorVersion); err != nil {
+		return err
+	}
 
-	// Compare versions
-	if pgDumpMajorVersion < dbMajorVersion {
-		return fmt.Errorf("version mismatch: pg_dump version %s is not compatible with database version %s", pgDumpMajorVersion, dbMajorVersion)
+	// Skip the dump when nothing was written since the previous snapshot
+	src := DatabaseSource(db)
+	var activity string
+	if db.SkipUnchanged {
+		if activity, err = databaseActivity(ctx, db); err != nil {
+			utils.Warnf("Warning: %v, dumping %s anyway", err, db.Name)
+		} else if previous, err := LatestSnapshot(ctx, r, src); err == nil &&
+			previous.Tags[TagActivity] == activity && snapshotTag(previous, TagServerVersion) == dbMajorVersion {
+			manifestID, err := reuseSnapshot(ctx, r, previous, src, db.Tags)
+			if err != nil {
+				return fmt.Errorf("reusing snapshot %v: %w", previous.ID, err)
+			}
+			utils.Infof("Database %s unchanged since snapshot %v, created snapshot %s without dumping", db.Name, previous.ID, manifestID)
+			return nil
+		}
 	}
 
-	// Create a unique temporary directory for this backup
-	timestamp := time.Now().Format("20060102_150405")
-	tmpDir := filepath.Join(".avolut", "tmp", fmt.Sprintf("%s_%s", db.Name, timestamp))
-	tmpFile := filepath.Join(tmpDir, "dump.sql")
+	// Run the hooks of the database around the dump, post-backup hooks run
+	// even if the dump fails but don't fail the backup themselves
+	if db.Hooks != nil {
+		defer func() {
+			if err := RunHooks(ctx, "postBackup", db.Hooks.PostBackup, commandEnv(db)); err != nil {
+				utils.Errorf("Error running post-backup hooks of database %s: %v", db.Name, err)
+			}
+		}()
+		if err := RunHooks(ctx, "preBackup", db.Hooks.PreBackup, commandEnv(db)); err != nil {
+			return err
+		}
+	}
 
-	// Ensure the temporary directory exists
-	if err := os.MkdirAll(tmpDir, 0700); err != nil {
-		return fmt.Errorf("creating temporary directory: %w", err)
+	// Apply the configured policy of the source
+	policyTree, err := applyPolicy(ctx, r, src, db.Policy)
+	if err != nil {
+		return err
 	}
 
-	// Prepare pg_dump command
-	cmd := exec.CommandContext(ctx, "pg_dump",
-		"--host", db.Host,
-		"--port", fmt.Sprintf("%d", db.Port),
-		"--username", db.User,
-		"--dbname", db.DBName,
-		"--schema", db.Schema,
-		"--file", tmpFile,
-	)
+	// Create a unique temporary directory for this backup
+	tmpDir, err := makeTempDir(db.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			utils.Warnf("Warning: error removing temporary directory: %v", err)
+		}
+	}()
+	tmpFile := filepath.Join(tmpDir, dumpNames[dumpFormat(db)])
 
-	// Set environment variables for authentication
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", db.Password))
+	// Make sure the dump fits before filling the volume
+	if err := checkDiskSpace(ctx, db, tmpDir); err != nil {
+		return err
+	}
 
-	// Execute pg_dump
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("executing pg_dump: %w\nOutput: %s", err, string(output))
+	switch {
+	case isPhysical(db):
+		// Copy the data directory and its WAL instead of dumping
+		if err := baseBackup(ctx, db, tmpDir); err != nil {
+			return err
+		}
+	case isMySQL(db):
+		if err := mysqlDump(ctx, db, tmpFile); err != nil {
+			return err
+		}
+	case isMongoDB(db):
+		if err := mongoDump(ctx, db, tmpDir); err != nil {
+			return err
+		}
+	case isSQLite(db):
+		if err := sqliteBackup(ctx, db, tmpDir); err != nil {
+			return err
+		}
+	case isRedis(db):
+		if err := redisDump(ctx, db, filepath.Join(tmpDir, redisDumpName)); err != nil {
+			return err
+		}
+	case db.PerTable:
+		// Dump every table into its own file for granular restores
+		if err := dumpTables(ctx, db, tmpDir); err != nil {
+			return err
+		}
+	default:
+		if err := dumper.Dump(ctx, db, tmpFile); err != nil {
+			return err
+		}
 	}
 
-	// Create source info for the snapshot
-	src := snapshot.SourceInfo{
-		Host:     "localhost",
-		UserName: os.Getenv("USER"),
-		Path:     tmpDir,
+	// Check the dump before uploading it, so a truncated dump of a pg_dump
+	// that still exited cleanly fails the backup instead of replacing a
+	// good snapshot
+	switch {
+	case isSQLite(db):
+		tmpFile = filepath.Join(tmpDir, sqliteDumpName)
+	case isRedis(db):
+		tmpFile = filepath.Join(tmpDir, redisDumpName)
+	}
+	checksum, size, err := checkDump(ctx, db, tmpFile)
+	if err != nil {
+		return err
 	}
 
 	// Create writer session
+	counter := newUploadCounter(ctx)
 	writeContext, writer, err := r.NewWriter(ctx, repo.WriteSessionOptions{
-		Purpose: "Backup database",
+		Purpose:  "Backup database",
+		OnUpload: counter.add,
 	})
 	if err != nil {
 		return fmt.Errorf("creating writer session: %w", err)
 	}
 	defer func() {
 		if cerr := writer.Close(writeContext); cerr != nil {
-			fmt.Printf("Warning: error closing writer: %v\n", cerr)
-		}
-		// Clean up temporary directory
-		if err := os.RemoveAll(tmpDir); err != nil {
-			fmt.Printf("Warning: error removing temporary directory: %v\n", err)
+			utils.Warnf("Warning: error closing writer: %v", cerr)
 		}
 	}()
 
+	// Record the versions that produced this dump so restores can detect
+	// cross-version mismatches
+	description := db.Description
+	if description == "" {
+		description = fmt.Sprintf("Backup of database %s", db.Name)
+	}
+	description = fmt.Sprintf("%s (server: %s; %s: %s)", description,
+		firstLine(dbVersion), dumpTool, firstLine(dumpVersion))
+
 	// Create manifest
 	manifest := &snapshot.Manifest{
 		Source:      src,
-		Description: fmt.Sprintf("Backup of database %s", db.Name),
+		Description: description,
 		StartTime:   fs.UTCTimestampFromTime(time.Now()),
+		Tags:        snapshotTags(db.Tags),
+	}
+	manifest.Tags[TagServerVersion] = dbMajorVersion
+	manifest.Tags[TagDumpVersion] = dumpMajorVersion
+	if activity != "" {
+		manifest.Tags[TagActivity] = activity
+	}
+	if checksum != "" {
+		manifest.Tags[TagDumpSHA256] = checksum
+		manifest.Tags[TagDumpSize] = strconv.FormatInt(size, 10)
 	}
 
 	// Create uploader
 	uploader := snapshotfs.NewUploader(writer)
+	uploader.Progress = newUploadProgress(ctx)
 
-	// Create policy tree
-	policyTree := policy.BuildTree(nil, policy.DefaultPolicy)
+	// Hash and upload dump files in parallel when the dump consists of many
+	// files, tuned automatically unless configured; single-file dumps keep
+	// kopia's default
+	parallel := 0
+	if files := countFiles(tmpDir); files > 1 {
+		parallel = db.ParallelUploads
+		if parallel <= 0 {
+			parallel = tuner.parallelism()
+		}
+		if parallel > 0 {
+			uploader.ParallelUploads = parallel
+			utils.Infof("Uploading %d dump files of %s with %d parallel uploads", files, db.Name, parallel)
+		}
+	}
 
 	// Upload the snapshot
 	entry, err := localfs.Directory(tmpDir)
 	if err != nil {
 		return fmt.Errorf("creating directory entry: %w", err)
 	}
+	uploadStart := time.Now()
 	uploaded, err := uploader.Upload(writeContext, entry, policyTree, src)
 	if err != nil {
+		tuner.record(parallel, counter.bytes.Load(), time.Since(uploadStart), err)
 		return fmt.Errorf("uploading database dump: %w", err)
 	}
+	uploadDuration := time.Since(uploadStart)
+	utils.Infof("Uploaded dump of %s (%d bytes) in %s", db.Name, uploaded.Stats.TotalFileSize, uploadDuration.Round(time.Millisecond))
 
 	// Update manifest
 	manifest.EndTime = fs.UTCTimestampFromTime(time.Now())
@@ -141,11 +278,238 @@ func BackupDatabase(ctx context.Context, r repo.Repository, db config.Database)
 	}
 
 	// Flush changes
-	if err := writer.Flush(writeContext); err != nil {
+	err = writer.Flush(writeContext)
+	tuner.record(parallel, counter.bytes.Load(), time.Since(uploadStart), err)
+	if err != nil {
 		return fmt.Errorf("flushing changes: %w", err)
 	}
+	recordSnapshot(ctx, manifestID, manifest.Stats)
 
 	// Log success
-	fmt.Printf("Created snapshot %v of database %s\n", manifestID, db.Name)
+	utils.Infof("Created snapshot %v of database %s", manifestID, db.Name)
+	return nil
+}
+
+// countFiles returns the number of regular files below dir
+func countFiles(dir string) int {
+	count := 0
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// pgCommand prepares a PostgreSQL client command connected and authenticated
+// as configured for db
+func pgCommand(ctx context.Context, db config.Database, name string, args ...string) *exec.Cmd {
+	connArgs := []string{
+		"--host", db.Host,
+		"--port", fmt.Sprintf("%d", db.Port),
+		"--username", db.User,
+	}
+	cmd := newCommand(ctx, name, append(connArgs, args...)...)
+	cmd.Env = pgEnv(db)
+	return cmd
+}
+
+// pgEnv returns the environment for PostgreSQL tools: the password and SSL
+// settings, followed by the custom variables configured for the database so
+// they take precedence
+func pgEnv(db config.Database) []string {
+	env := append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", db.Password))
+	if db.SSLMode != "" {
+		env = append(env, fmt.Sprintf("PGSSLMODE=%s", db.SSLMode))
+	}
+	if db.SSLRootCert != "" {
+		env = append(env, fmt.Sprintf("PGSSLROOTCERT=%s", db.SSLRootCert))
+	}
+	for key, value := range db.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
+
+// databaseVersion returns the version string reported by the database server
+func databaseVersion(ctx context.Context, db config.Database) (string, error) {
+	if isRedis(db) {
+		return redisVersion(ctx, db)
+	}
+	cmd := pgCommand(ctx, db, "psql",
+		"--dbname", db.DBName,
+		"--tuples-only",
+		"--command", "SELECT version();",
+	)
+	if isMySQL(db) {
+		cmd = mysqlCommand(ctx, db, "mysql",
+			"--batch",
+			"--skip-column-names",
+			"--execute", "SELECT VERSION();",
+			db.DBName,
+		)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("getting database version: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("getting database version: %w", err)
+	}
+	return string(output), nil
+}
+
+// CheckConnection connects to db once and returns the version of its server.
+// MongoDB can't be checked without connecting through mongosh.
+func CheckConnection(ctx context.Context, db config.Database) (string, error) {
+	switch {
+	case isMongoDB(db):
+		return "", fmt.Errorf("connection checks are not supported for MongoDB")
+	case isSQLite(db):
+		// sqlite3 would create a missing database file
+		if _, err := os.Stat(db.Path); err != nil {
+			return "", fmt.Errorf("opening database file: %w", err)
+		}
+		output, err := newCommand(ctx, "sqlite3", "-bail", "-readonly", db.Path, "SELECT 'SQLite ' || sqlite_version();").CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("opening database file: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return string(output), nil
+	default:
+		return databaseVersion(ctx, db)
+	}
+}
+
+// permanentConnectErrors are psql messages for failures that retrying won't fix
+var permanentConnectErrors = []string{
+	"authentication failed",
+	"no pg_hba.conf entry",
+	"role \"",
+	"database \"",
+	"permission denied",
+	"Access denied",
+	"Unknown database",
+	"NOAUTH",
+	"WRONGPASS",
+}
+
+// waitForDatabase returns the database version, retrying while the database
+// is not ready yet. Authentication and similar errors fail immediately.
+func waitForDatabase(ctx context.Context, db config.Database) (string, error) {
+	attempts, interval := db.ConnectAttempts, db.ConnectInterval
+	if attempts <= 0 {
+		attempts = 6
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		version, err := databaseVersion(ctx, db)
+		if err == nil {
+			return version, nil
+		}
+		for _, msg := range permanentConnectErrors {
+			if strings.Contains(err.Error(), msg) {
+				return "", err
+			}
+		}
+		if attempt >= attempts {
+			return "", fmt.Errorf("database not ready after %d attempts: %w", attempts, err)
+		}
+
+		utils.Infof("Database %s not ready (attempt %d/%d), retrying in %s: %v", db.Name, attempt, attempts, interval, err)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// toolVersion returns the version output of a dump tool
+func toolVersion(name string) (string, error) {
+	output, err := exec.Command(name, "--version").Output()
+	return string(output), err
+}
+
+// firstLine returns the first line of a version output without surrounding
+// whitespace, tools like mongodump print more details on further lines
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(line)
+}
+
+// dumpSchema returns the schema backed up for db
+func dumpSchema(db config.Database) string {
+	if db.Schema == "" {
+		return "public"
+	}
+	return db.Schema
+}
+
+// dumpTables writes the schema definition to schema.sql and every table of
+// the configured schema to tables/<table>.sql below dir
+func dumpTables(ctx context.Context, db config.Database, dir string) error {
+	schema := dumpSchema(db)
+
+	// List the tables of the schema
+	query := fmt.Sprintf("SELECT tablename FROM pg_tables WHERE schemaname = '%s' ORDER BY tablename;", strings.ReplaceAll(schema, "'", "''"))
+	output, err := pgCommand(ctx, db, "psql",
+		"--dbname", db.DBName,
+		"--tuples-only",
+		"--no-align",
+		"--command", query,
+	).Output()
+	if err != nil {
+		return fmt.Errorf("listing tables: %w", err)
+	}
+
+	// Dump the schema definition so the whole database can be recreated
+	cmd := pgCommand(ctx, db, "pg_dump",
+		"--dbname", db.DBName,
+		"--schema", schema,
+		"--schema-only",
+		"--file", filepath.Join(dir, "schema.sql"),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing pg_dump for schema: %w\nOutput: %s", err, string(output))
+	}
+
+	tablesDir := filepath.Join(dir, "tables")
+	if err := os.MkdirAll(tablesDir, 0700); err != nil {
+		return fmt.Errorf("creating tables directory: %w", err)
+	}
+
+	for _, table := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if table == "" {
+			continue
+		}
+
+		// Dump table definition and data, dropping an existing table on restore
+		cmd := pgCommand(ctx, db, "pg_dump",
+			"--dbname", db.DBName,
+			"--table", quoteIdentifier(schema)+"."+quoteIdentifier(table),
+			"--clean",
+			"--if-exists",
+			"--file", filepath.Join(tablesDir, tableFileName(table)),
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("executing pg_dump for table %s: %w\nOutput: %s", table, err, string(output))
+		}
+	}
+
 	return nil
 }
+
+// quoteIdentifier quotes a PostgreSQL identifier so it is matched exactly
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// tableFileName returns the dump file name used for a table
+func tableFileName(table string) string {
+	return strings.ReplaceAll(table, "/", "_") + ".sql"
+}
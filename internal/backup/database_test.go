@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+// fakeDumper reports fixed versions and writes a canned dump
+type fakeDumper struct {
+	toolVersion, serverVersion string
+	dump                       string
+	err                        error
+}
+
+func (d fakeDumper) ToolVersion(ctx context.Context) (string, error) {
+	return d.toolVersion, nil
+}
+
+func (d fakeDumper) ServerVersion(ctx context.Context, db config.Database) (string, error) {
+	return d.serverVersion, nil
+}
+
+func (d fakeDumper) Dump(ctx context.Context, db config.Database, file string) error {
+	if d.err != nil {
+		return d.err
+	}
+	return os.WriteFile(file, []byte(d.dump), 0600)
+}
+
+func TestBackupDatabase(t *testing.T) {
+	ctx := context.Background()
+	r := testRepository(t)
+	setSourceIdentity(t, "web1", "backup")
+	tempDir := t.TempDir()
+	SetTempDir(tempDir)
+	t.Cleanup(func() { SetTempDir("") })
+
+	const dump = "CREATE TABLE items (id integer);\n"
+	dumper := fakeDumper{
+		toolVersion:   "pg_dump (PostgreSQL) 16.2",
+		serverVersion: "PostgreSQL 16.1 on x86_64-pc-linux-gnu",
+		dump:          dump,
+	}
+	newer := dumper
+	newer.serverVersion = "PostgreSQL 17.0 on x86_64-pc-linux-gnu"
+	failing := dumper
+	failing.err = errors.New("pg_dump crashed")
+	empty := dumper
+	empty.dump = ""
+
+	tests := []struct {
+		name    string
+		dumper  fakeDumper
+		wantErr string
+	}{
+		{"dump", dumper, ""},
+		{"newer server", newer, "version mismatch"},
+		{"failed dump", failing, "pg_dump crashed"},
+		{"empty dump", empty, "is empty"},
+	}
+	for _, tt := range tests {
+		// An unreachable server only skips the disk space check
+		db := config.Database{Name: tt.name, Host: "127.0.0.1", Port: 1, DBName: "app", User: "app"}
+		err := BackupDatabase(ctx, r, db, tt.dumper)
+		// The dump directory is removed whether the backup failed or not
+		if left, _ := os.ReadDir(tempDir); len(left) > 0 {
+			t.Errorf("%s: BackupDatabase() left %s in the temp directory", tt.name, left[0].Name())
+		}
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: BackupDatabase() = %v, want an error containing %q", tt.name, err, tt.wantErr)
+			}
+			if _, err := LatestSnapshot(ctx, r, DatabaseSource(db)); err == nil {
+				t.Errorf("%s: BackupDatabase() created a snapshot", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: BackupDatabase() = %v", tt.name, err)
+			continue
+		}
+
+		manifest, root, err := latestDatabaseSnapshot(ctx, r, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := manifest.Tags[TagServerVersion]; got != "16" {
+			t.Errorf("%s: server version tag = %q, want 16", tt.name, got)
+		}
+		entry, err := snapshotfs.GetNestedEntry(ctx, root, []string{dumpNames[formatPlain]})
+		if err != nil {
+			t.Fatalf("%s: snapshot has no dump: %v", tt.name, err)
+		}
+		f, err := entry.(fs.File).Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != dump {
+			t.Errorf("%s: snapshot dump = %q, want %q", tt.name, got, dump)
+		}
+	}
+}
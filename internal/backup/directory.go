@@ -5,80 +5,142 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/avolut/backup/internal/config"
 	"github.com/avolut/backup/internal/utils"
 	"github.com/kopia/kopia/fs"
 	"github.com/kopia/kopia/fs/localfs"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/snapshot"
-	"github.com/kopia/kopia/snapshot/policy"
 	"github.com/kopia/kopia/snapshot/snapshotfs"
 )
 
-func BackupDir(ctx context.Context, r repo.Repository, dirPath string) error {
-	// Set process priority to reduce CPU usage
-	if err := utils.SetProcessPriority(); err != nil {
-		fmt.Printf("Warning: failed to set process priority: %v\n", err)
+// BackupDir snapshots dir. The state directory and the directories in skip,
+// like the temp directory or filesystem storage, are left out when they are
+// inside dir.
+func BackupDir(ctx context.Context, r repo.Repository, dir config.Directory, skip []string) error {
+	dirPath := dir.Path
+
+	// Copy remote directories to a local mirror first
+	localPath := dirPath
+	remote, isRemote, err := config.ParseRemote(dirPath)
+	if err != nil {
+		return err
+	}
+	if isRemote {
+		if localPath, err = syncRemote(ctx, remote, dir.SSHKey); err != nil {
+			return err
+		}
 	}
 
 	// Verify directory exists
-	info, err := os.Stat(dirPath)
+	info, err := os.Stat(localPath)
 	if err != nil {
-		return fmt.Errorf("error accessing directory %s: %v", dirPath, err)
+		return fmt.Errorf("error accessing directory %s: %v", localPath, err)
 	}
 	if !info.IsDir() {
-		return fmt.Errorf("%s is not a directory", dirPath)
+		return fmt.Errorf("%s is not a directory", localPath)
 	}
 
-	// Create source directory entry
-	source, err := filepath.Abs(dirPath)
+	// Create snapshot source
+	src, err := DirectorySource(dirPath)
+	if err != nil {
+		return err
+	}
+	source, err := filepath.Abs(localPath)
 	if err != nil {
 		return fmt.Errorf("error getting absolute path: %v", err)
 	}
+	name := source
+	if isRemote {
+		name = dirPath
+	}
 
 	// Create entry point for the directory
 	entry, err := localfs.Directory(source)
 	if err != nil {
 		return fmt.Errorf("error creating directory entry: %w", err)
 	}
+	if dir.SkipSpecialFiles {
+		entry = newFilteredDirectory(entry, isSpecialFile)
+	}
+	if dir.SparseFiles != "" {
+		isSparse, err := sparseFileFilter(dir.SparseFiles)
+		if err != nil {
+			return err
+		}
+		entry = newFilteredDirectory(entry, isSparse)
+	}
 
-	// Create snapshot source
-	src := snapshot.SourceInfo{
-		Host:     "localhost",
-		UserName: os.Getenv("USER"),
-		Path:     source,
+	// Never back up our own files, the state directory holds the cache and
+	// the repository configuration, the others dumps and repositories
+	for _, own := range append([]string{".avolut"}, skip...) {
+		own, err := filepath.Abs(own)
+		if err != nil || own == source || !isWithin(own, source) {
+			continue
+		}
+		utils.Warnf("Warning: %s contains %s of the backup itself, excluding it from the backup", source, own)
+		entry = newFilteredDirectory(entry, func(e fs.Entry) bool {
+			return e.LocalFilesystemPath() == own
+		})
+	}
+
+	// Apply the configured policy of the source
+	policyTree, err := applyPolicy(ctx, r, src, directoryPolicy(dir))
+	if err != nil {
+		return err
 	}
 
 	// Create writer session
+	counter := newUploadCounter(ctx)
 	writeContext, writer, err := r.NewWriter(ctx, repo.WriteSessionOptions{
-		Purpose: "Backup directory",
+		Purpose:  "Backup directory",
+		OnUpload: counter.add,
 	})
 	if err != nil {
 		return fmt.Errorf("creating writer session: %w", err)
 	}
 	defer func() {
 		if cerr := writer.Close(writeContext); cerr != nil {
-			fmt.Printf("Warning: error closing writer: %v\n", cerr)
+			utils.Warnf("Warning: error closing writer: %v", cerr)
 		}
 	}()
 
+	// Look up the previous snapshots, files unchanged since then are taken
+	// over without reading them
+	previous, err := previousSnapshots(ctx, r, src)
+	if err != nil {
+		return err
+	}
+
 	// Create uploader
 	uploader := snapshotfs.NewUploader(writer)
-
-	// Create policy tree
-	policyTree := policy.BuildTree(nil, policy.DefaultPolicy)
+	reuse := &reuseCounter{UploadProgress: newUploadProgress(ctx)}
+	uploader.Progress = reuse
+	parallel := tuner.parallelism()
+	if parallel > 0 {
+		uploader.ParallelUploads = parallel
+	}
 
 	// Create manifest
+	description := dir.Description
+	if description == "" {
+		description = fmt.Sprintf("Backup of %s", name)
+	}
 	manifest := &snapshot.Manifest{
 		Source:      src,
-		Description: fmt.Sprintf("Backup of %s", source),
+		Description: description,
+		Tags:        snapshotTags(dir.Tags),
 	}
 	manifest.StartTime = fs.UTCTimestampFromTime(time.Now())
 
 	// Upload the snapshot
-	uploaded, err := uploader.Upload(writeContext, entry, policyTree, src)
+	uploadStart := time.Now()
+	uploaded, err := uploader.Upload(writeContext, entry, policyTree, src, previous...)
 	if err != nil {
+		tuner.record(parallel, counter.bytes.Load(), time.Since(uploadStart), err)
 		return fmt.Errorf("uploading directory: %w", err)
 	}
 
@@ -94,11 +156,26 @@ func BackupDir(ctx context.Context, r repo.Repository, dirPath string) error {
 	}
 
 	// Flush changes
-	if err := writer.Flush(writeContext); err != nil {
+	err = writer.Flush(writeContext)
+	tuner.record(parallel, counter.bytes.Load(), time.Since(uploadStart), err)
+	if err != nil {
 		return fmt.Errorf("flushing changes: %w", err)
 	}
+	recordSnapshot(ctx, manifestID, manifest.Stats)
 
 	// Log success
-	fmt.Printf("Created snapshot %v of %v\n", manifestID, source)
+	utils.Infof("Created snapshot %v of %v", manifestID, name)
+	if len(previous) > 0 {
+		cached, hashed := reuse.cached.Load(), reuse.hashed.Load()
+		utils.Infof("Reused %d unchanged files (%d bytes, %.0f%% of the data) from the previous snapshot, hashed %d bytes of %d new or changed files in %s",
+			manifest.Stats.CachedFiles, cached, 100*float64(cached)/float64(max(cached+hashed, 1)),
+			hashed, manifest.Stats.NonCachedFiles, manifest.EndTime.Sub(manifest.StartTime).Round(time.Millisecond))
+	}
 	return nil
 }
+
+// isWithin reports whether path is dir itself or inside it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
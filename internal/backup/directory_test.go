@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+func TestBackupDirExclude(t *testing.T) {
+	ctx := context.Background()
+	r := testRepository(t)
+	setSourceIdentity(t, "web1", "backup")
+
+	files := []string{"app.go", "debug.log", "cache/page", "lib/cache/page", "lib/trace.log", "node_modules/pkg/index.js"}
+	tests := []struct {
+		exclude []string
+		want    []string
+	}{
+		{nil, []string{"app.go", "cache/page", "debug.log", "lib/cache/page", "lib/trace.log", "node_modules/pkg/index.js"}},
+		{[]string{"*.log"}, []string{"app.go", "cache/page", "lib/cache/page", "node_modules/pkg/index.js"}},
+		{[]string{"node_modules/", "/cache"}, []string{"app.go", "debug.log", "lib/cache/page", "lib/trace.log"}},
+		{[]string{"cache", "*.log", "*.go"}, []string{"node_modules/pkg/index.js"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for _, name := range files {
+			file := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := BackupDir(ctx, r, config.Directory{Path: dir, Exclude: tt.exclude}, nil); err != nil {
+			t.Fatalf("BackupDir(exclude %q) = %v", tt.exclude, err)
+		}
+		if got := snapshotFiles(t, r, dir); !slices.Equal(got, tt.want) {
+			t.Errorf("BackupDir(exclude %q) snapshot files = %q, want %q", tt.exclude, got, tt.want)
+		}
+	}
+}
+
+func TestBackupDirSkipsOwnDirectories(t *testing.T) {
+	ctx := context.Background()
+	r := testRepository(t)
+	setSourceIdentity(t, "web1", "backup")
+
+	dir := t.TempDir()
+	for _, name := range []string{"data/app.db", "tmp/avolut-main-1/dump.sql", "storage/test/files/kopia.repository"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		skip []string
+		want []string
+	}{
+		{nil, []string{"data/app.db", "storage/test/files/kopia.repository", "tmp/avolut-main-1/dump.sql"}},
+		{[]string{filepath.Join(dir, "tmp")}, []string{"data/app.db", "storage/test/files/kopia.repository"}},
+		{[]string{filepath.Join(dir, "tmp"), filepath.Join(dir, "storage")}, []string{"data/app.db"}},
+		// Directories outside of dir change nothing
+		{[]string{t.TempDir()}, []string{"data/app.db", "storage/test/files/kopia.repository", "tmp/avolut-main-1/dump.sql"}},
+	}
+	for _, tt := range tests {
+		if err := BackupDir(ctx, r, config.Directory{Path: dir}, tt.skip); err != nil {
+			t.Fatalf("BackupDir(skip %q) = %v", tt.skip, err)
+		}
+		if got := snapshotFiles(t, r, dir); !slices.Equal(got, tt.want) {
+			t.Errorf("BackupDir(skip %q) snapshot files = %q, want %q", tt.skip, got, tt.want)
+		}
+	}
+}
+
+// snapshotFiles lists the files in the latest snapshot of dir, relative to
+// its root and sorted
+func snapshotFiles(t *testing.T, r repo.Repository, dir string) []string {
+	t.Helper()
+	ctx := context.Background()
+	src, err := DirectorySource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := LatestSnapshot(ctx, r, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := snapshotfs.SnapshotRoot(r, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	var walk func(d fs.Directory, prefix string)
+	walk = func(d fs.Directory, prefix string) {
+		entries, err := fs.GetAllEntries(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if sub, ok := e.(fs.Directory); ok {
+				walk(sub, path.Join(prefix, e.Name()))
+			} else {
+				files = append(files, path.Join(prefix, e.Name()))
+			}
+		}
+	}
+	walk(root.(fs.Directory), "")
+	slices.Sort(files)
+	return files
+}
@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+)
+
+// Default diskHeadroom: plain dumps and base backups are about as large as
+// the database, compressed custom and directory dumps much smaller
+const (
+	defaultHeadroom           = 1.2
+	defaultCompressedHeadroom = 0.5
+)
+
+// checkDiskSpace fails if the volume of dir has less free space than the
+// database size times the headroom of db. It is skipped for MySQL, MongoDB
+// and Redis and when the size can't be determined.
+func checkDiskSpace(ctx context.Context, db config.Database, dir string) error {
+	if isMySQL(db) || isMongoDB(db) || isRedis(db) {
+		return nil
+	}
+
+	size, err := databaseSize(ctx, db)
+	if err != nil {
+		utils.Warnf("Warning: %v, skipping the disk space check of %s", err, db.Name)
+		return nil
+	}
+	free, ok, err := freeSpace(dir)
+	if err != nil {
+		utils.Warnf("Warning: %v, skipping the disk space check of %s", err, db.Name)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	headroom := db.DiskHeadroom
+	if headroom <= 0 {
+		headroom = defaultHeadroom
+		if !isPhysical(db) && dumpFormat(db) != formatPlain {
+			headroom = defaultCompressedHeadroom
+		}
+	}
+	if needed := uint64(float64(size) * headroom); free < needed {
+		return fmt.Errorf("not enough disk space for the dump of %s: %s has %d MB free, %d MB needed (database size %d MB, headroom %.1f)",
+			db.Name, dir, free>>20, needed>>20, size>>20, headroom)
+	}
+	return nil
+}
+
+// databaseSize returns the approximate size of the database in bytes, or of
+// all databases of the server for a physical backup
+func databaseSize(ctx context.Context, db config.Database) (uint64, error) {
+	if isSQLite(db) {
+		info, err := os.Stat(db.Path)
+		if err != nil {
+			return 0, fmt.Errorf("getting database file size: %w", err)
+		}
+		return uint64(info.Size()), nil
+	}
+
+	query := "SELECT pg_database_size(current_database());"
+	if isPhysical(db) {
+		query = "SELECT sum(pg_database_size(datname))::bigint FROM pg_database;"
+	}
+	output, err := pgCommand(ctx, db, "psql",
+		"--dbname", db.DBName,
+		"--tuples-only",
+		"--no-align",
+		"--command", query,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("querying database size: %w", err)
+	}
+
+	size, err := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing database size %q: %w", strings.TrimSpace(string(output)), err)
+	}
+	return size, nil
+}
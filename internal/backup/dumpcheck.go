@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// Snapshot tags recording the SHA-256 checksum and size in bytes of a dump
+// file, so a restored dump can be compared against what was uploaded
+const (
+	TagDumpSHA256 = "tag:dump-sha256"
+	TagDumpSize   = "tag:dump-size"
+)
+
+// checkDump verifies the dump written to file before it is uploaded: a dump
+// file must not be empty, custom and directory dumps must be readable by
+// pg_restore and Redis dumps must be RDB files. It returns the checksum and
+// size of a dump file, or "" and 0 when the dump is a directory or not
+// written to file at all.
+func checkDump(ctx context.Context, db config.Database, file string) (string, int64, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("checking dump: %w", err)
+	}
+
+	// pg_restore reads the table of contents, which a truncated archive
+	// doesn't have in one piece
+	if format := dumpFormat(db); format == formatCustom || format == formatDirectory {
+		var stderr bytes.Buffer
+		cmd := newCommand(ctx, "pg_restore", "--list", file)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return "", 0, fmt.Errorf("checking dump of %s with pg_restore --list: %w\nOutput: %s", db.Name, err, stderr.String())
+		}
+	}
+	if info.IsDir() {
+		return "", 0, nil
+	}
+
+	if info.Size() == 0 {
+		return "", 0, fmt.Errorf("dump of %s is empty", db.Name)
+	}
+	if isRedis(db) {
+		if err := checkRDB(file); err != nil {
+			return "", 0, err
+		}
+	}
+	checksum, err := fileChecksum(file)
+	if err != nil {
+		return "", 0, err
+	}
+	return checksum, info.Size(), nil
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of a local file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening dump: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("reading dump: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
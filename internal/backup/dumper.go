@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// Dumper runs the PostgreSQL client tools for logical backups, so tests can
+// replace them with a fake that needs no server or binaries
+type Dumper interface {
+	// ToolVersion returns the version output of the dump tool
+	ToolVersion(ctx context.Context) (string, error)
+	// ServerVersion returns the version string of the server of db, waiting
+	// for the server to become ready
+	ServerVersion(ctx context.Context, db config.Database) (string, error)
+	// Dump writes a dump of db in its configured format to file
+	Dump(ctx context.Context, db config.Database, file string) error
+}
+
+// pgDumper dumps with pg_dump and queries the server with psql
+type pgDumper struct{}
+
+func (pgDumper) ToolVersion(ctx context.Context) (string, error) {
+	output, err := newCommand(ctx, "pg_dump", "--version").Output()
+	return string(output), err
+}
+
+func (pgDumper) ServerVersion(ctx context.Context, db config.Database) (string, error) {
+	return waitForDatabase(ctx, db)
+}
+
+func (pgDumper) Dump(ctx context.Context, db config.Database, file string) error {
+	// A directory dump creates file as a directory that is snapshotted along
+	// with everything in it
+	args := append([]string{
+		"--dbname", db.DBName,
+		"--schema", db.Schema,
+		"--file", file,
+	}, formatArgs(db)...)
+	args = append(args, filterArgs(db)...)
+	cmd := pgCommand(ctx, db, "pg_dump", args...)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing pg_dump: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// filterArgs returns the pg_dump arguments selecting the tables and schemas
+// of db that are dumped
+func filterArgs(db config.Database) []string {
+	var args []string
+	for _, pattern := range db.IncludeTables {
+		args = append(args, "--table", pattern)
+	}
+	for _, pattern := range db.ExcludeTables {
+		args = append(args, "--exclude-table", pattern)
+	}
+	for _, pattern := range db.ExcludeSchemas {
+		args = append(args, "--exclude-schema", pattern)
+	}
+	return args
+}
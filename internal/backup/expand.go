@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+)
+
+// ExpandDirectories replaces glob patterns like /srv/apps/*/data by the
+// directories they match and @file entries by the paths listed in file, one
+// per line. The expanded directories keep the options of their entry. A
+// pattern without matches is logged and skipped, a list that can't be read is
+// an error.
+func ExpandDirectories(dirs []config.Directory) ([]config.Directory, error) {
+	return expandDirectories(dirs, true)
+}
+
+// expandDirectories expands dirs like ExpandDirectories, logging patterns
+// and lists that name no directories only when warn is set
+func expandDirectories(dirs []config.Directory, warn bool) ([]config.Directory, error) {
+	var expanded []config.Directory
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		paths := []string{dir.Path}
+		if list, ok := strings.CutPrefix(dir.Path, "@"); ok {
+			var err error
+			if paths, err = readDirectoryList(list); err != nil {
+				return nil, err
+			}
+			if len(paths) == 0 && warn {
+				utils.Warnf("Warning: directory list %s is empty", list)
+			}
+		}
+
+		for _, path := range paths {
+			matches, err := expandPattern(path)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 && warn {
+				utils.Warnf("Warning: %s matches no directories, skipping it", path)
+			}
+			for _, match := range matches {
+				// Back up a directory matched by several entries once, with
+				// the options of the first
+				key := match
+				if _, isRemote, _ := config.ParseRemote(match); !isRemote {
+					key = filepath.Clean(match)
+				}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				d := dir
+				d.Path = match
+				expanded = append(expanded, d)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// expandPattern returns the directories matched by a glob pattern, or path
+// itself when it is no pattern, a remote path or an existing path whose name
+// happens to contain glob characters
+func expandPattern(path string) ([]string, error) {
+	if _, isRemote, _ := config.ParseRemote(path); isRemote || !strings.ContainsAny(path, "*?[") {
+		return []string{path}, nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return []string{path}, nil
+	}
+
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", path, err)
+	}
+	var dirs []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			dirs = append(dirs, match)
+		}
+	}
+	return dirs, nil
+}
+
+// readDirectoryList reads the paths or patterns listed in file, skipping
+// empty lines and # comments
+func readDirectoryList(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory list: %w", err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, nil
+}
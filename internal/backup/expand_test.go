@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+func TestExpandDirectories(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"apps/shop/data", "apps/blog/data", "apps/wiki", "odd[1]"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file matched by a pattern is not a directory to back up
+	if err := os.WriteFile(filepath.Join(root, "apps", "notes"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := func(rel string) string { return filepath.Join(root, rel) }
+
+	list := filepath.Join(root, "dirs.txt")
+	listed := "# generated\n" + path("apps/wiki") + "\n\n  " + path("apps/*/data") + "  \n"
+	if err := os.WriteFile(list, []byte(listed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(root, "empty.txt")
+	if err := os.WriteFile(empty, []byte("# nothing yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dirs    []string
+		want    []string
+		wantErr bool
+	}{
+		{"plain path", []string{"/srv/data"}, []string{"/srv/data"}, false},
+		{"missing plain path", []string{path("missing")}, []string{path("missing")}, false},
+		{"remote path", []string{"ssh://backup@db1/srv/*"}, []string{"ssh://backup@db1/srv/*"}, false},
+		{"pattern", []string{path("apps/*/data")}, []string{path("apps/blog/data"), path("apps/shop/data")}, false},
+		{"pattern of directories only", []string{path("apps/*")}, []string{path("apps/blog"), path("apps/shop"), path("apps/wiki")}, false},
+		{"pattern without matches", []string{path("apps/*/cache")}, nil, false},
+		{"existing path with glob characters", []string{path("odd[1]")}, []string{path("odd[1]")}, false},
+		{"list", []string{"@" + list}, []string{path("apps/wiki"), path("apps/blog/data"), path("apps/shop/data")}, false},
+		{"empty list", []string{"@" + empty}, nil, false},
+		{"missing list", []string{"@" + path("missing.txt")}, nil, true},
+		{"duplicates", []string{path("apps/shop/data"), path("apps/*/data"), path("apps/shop/data/")}, []string{path("apps/shop/data"), path("apps/blog/data")}, false},
+	}
+	for _, tt := range tests {
+		var dirs []config.Directory
+		for _, d := range tt.dirs {
+			dirs = append(dirs, config.Directory{Path: d})
+		}
+		expanded, err := ExpandDirectories(dirs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ExpandDirectories(%q) error = %v, want error %v", tt.name, tt.dirs, err, tt.wantErr)
+			continue
+		}
+		if got := itemNames(expanded, nil); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: ExpandDirectories(%q) = %q, want %q", tt.name, tt.dirs, got, tt.want)
+		}
+	}
+}
+
+func TestExpandDirectoriesKeepsOptions(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := config.Directory{Path: filepath.Join(root, "*"), Exclude: []string{"*.log"}, Timeout: time.Hour}
+	expanded, err := ExpandDirectories([]config.Directory{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expanded) != 2 {
+		t.Fatalf("ExpandDirectories(%q) = %d directories, want 2", dir.Path, len(expanded))
+	}
+	for _, d := range expanded {
+		if !slices.Equal(d.Exclude, dir.Exclude) || d.Timeout != dir.Timeout {
+			t.Errorf("ExpandDirectories(%q) entry %s has exclude %q and timeout %v, want %q and %v", dir.Path, d.Path, d.Exclude, d.Timeout, dir.Exclude, dir.Timeout)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/fs"
+)
+
+// filteredDirectory wraps a directory and leaves out entries rejected by skip,
+// recursively for all subdirectories
+type filteredDirectory struct {
+	fs.Directory
+	skip func(e fs.Entry) bool
+}
+
+func newFilteredDirectory(dir fs.Directory, skip func(e fs.Entry) bool) fs.Directory {
+	return &filteredDirectory{Directory: dir, skip: skip}
+}
+
+func (d *filteredDirectory) wrap(e fs.Entry) fs.Entry {
+	if dir, ok := e.(fs.Directory); ok {
+		return newFilteredDirectory(dir, d.skip)
+	}
+	return e
+}
+
+func (d *filteredDirectory) Child(ctx context.Context, name string) (fs.Entry, error) {
+	e, err := d.Directory.Child(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if d.skip(e) {
+		return nil, fs.ErrEntryNotFound
+	}
+	return d.wrap(e), nil
+}
+
+func (d *filteredDirectory) Iterate(ctx context.Context) (fs.DirectoryIterator, error) {
+	iter, err := d.Directory.Iterate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &filteredIterator{DirectoryIterator: iter, dir: d}, nil
+}
+
+type filteredIterator struct {
+	fs.DirectoryIterator
+	dir *filteredDirectory
+}
+
+func (it *filteredIterator) Next(ctx context.Context) (fs.Entry, error) {
+	for {
+		e, err := it.DirectoryIterator.Next(ctx)
+		if e == nil || err != nil {
+			return e, err
+		}
+		if !it.dir.skip(e) {
+			return it.dir.wrap(e), nil
+		}
+	}
+}
+
+// isSpecialFile reports whether the entry is a socket, named pipe or device
+// and logs the ones it finds
+func isSpecialFile(e fs.Entry) bool {
+	if e.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) == 0 {
+		return false
+	}
+	utils.Infof("Skipping special file %s", e.LocalFilesystemPath())
+	return true
+}
+
+// sparseFileFilter returns a skip function that finds sparse files, whose
+// apparent size vastly exceeds the space allocated for them. kopia reads
+// such files fully expanded; the holes deduplicate to little stored data but
+// still cost time. mode "warn" logs them, "skip" also leaves them out.
+func sparseFileFilter(mode string) (func(e fs.Entry) bool, error) {
+	mode = strings.ToLower(mode)
+	if mode != "warn" && mode != "skip" {
+		return nil, fmt.Errorf("unknown sparseFiles mode %q, use warn or skip", mode)
+	}
+
+	return func(e fs.Entry) bool {
+		if !e.Mode().IsRegular() || e.Size() < 1<<20 {
+			return false
+		}
+		allocated, ok := allocatedSize(e.LocalFilesystemPath())
+		if !ok || allocated*4 >= e.Size() {
+			return false
+		}
+
+		if mode == "skip" {
+			utils.Infof("Skipping sparse file %s (%d bytes, %d allocated)", e.LocalFilesystemPath(), e.Size(), allocated)
+			return true
+		}
+		utils.Warnf("Warning: sparse file %s will be read expanded (%d bytes, %d allocated)", e.LocalFilesystemPath(), e.Size(), allocated)
+		return false
+	}, nil
+}
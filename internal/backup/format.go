@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot/restore"
+)
+
+// pg_dump output formats
+const (
+	formatPlain     = "plain"
+	formatCustom    = "custom"
+	formatDirectory = "directory"
+)
+
+// dumpNames maps each format to the name of its dump in the snapshot. A
+// directory dump is a directory that pg_dump creates itself.
+var dumpNames = map[string]string{
+	formatPlain:     "dump.sql",
+	formatCustom:    "dump.custom",
+	formatDirectory: "dump",
+}
+
+// dumpFormat returns the configured pg_dump format of db
+func dumpFormat(db config.Database) string {
+	if db.Format == "" {
+		return formatPlain
+	}
+	return db.Format
+}
+
+// validateFormat checks that the dump format options of db can be combined
+func validateFormat(db config.Database) error {
+	format := dumpFormat(db)
+	if _, ok := dumpNames[format]; !ok {
+		return fmt.Errorf("unknown dump format %q, use %s, %s or %s", db.Format, formatPlain, formatCustom, formatDirectory)
+	}
+	if db.Jobs < 0 {
+		return fmt.Errorf("jobs must not be negative")
+	}
+	// pg_dump only writes the directory format from several processes
+	if db.Jobs > 1 && format != formatDirectory {
+		return fmt.Errorf("jobs requires the %s format", formatDirectory)
+	}
+	if format == formatPlain {
+		// A compressed plain dump can't be piped into psql
+		if db.Compression != nil {
+			return fmt.Errorf("compression requires the %s or %s format", formatCustom, formatDirectory)
+		}
+		return nil
+	}
+	if isMySQL(db) || isMongoDB(db) || isSQLite(db) || isRedis(db) || db.PerTable {
+		return fmt.Errorf("the %s format is only supported for whole PostgreSQL dumps", format)
+	}
+	return nil
+}
+
+// formatArgs returns the pg_dump arguments selecting the format of db
+func formatArgs(db config.Database) []string {
+	var args []string
+	switch dumpFormat(db) {
+	case formatCustom:
+		args = append(args, "--format", "custom")
+	case formatDirectory:
+		args = append(args, "--format", "directory")
+		if db.Jobs > 1 {
+			args = append(args, "--jobs", strconv.Itoa(db.Jobs))
+		}
+	}
+	if db.Compression != nil {
+		args = append(args, "--compress", strconv.Itoa(*db.Compression))
+	}
+	return args
+}
+
+// checkParallelDump fails when db dumps with several jobs but the server,
+// of major version serverVersion, is older than 9.3 and can't serve them
+func checkParallelDump(db config.Database, serverVersion string) error {
+	if db.Jobs <= 1 {
+		return nil
+	}
+	if cmp, ok := comparePGVersions(serverVersion, "9.3"); ok && cmp < 0 {
+		return fmt.Errorf("parallel dumps with jobs need PostgreSQL 9.3 or newer, the server is %s", serverVersion)
+	}
+	return nil
+}
+
+// restoreArchive loads a custom or directory dump with pg_restore. The dump
+// is restored from the snapshot to a temporary directory first, since
+// parallel pg_restore jobs need to seek in it.
+func restoreArchive(ctx context.Context, r repo.Repository, db config.Database, entry fs.Entry) error {
+	tmpDir, err := makeTempDir(db.Name + "-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	target, err := restoreToDir(ctx, r, entry, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	jobs := max(db.RestoreJobs, 1)
+	cmd := pgCommand(ctx, db, "pg_restore",
+		"--dbname", db.DBName,
+		"--exit-on-error",
+		"--jobs", strconv.Itoa(jobs),
+		target,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing pg_restore: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// restoreToDir restores a dump file or directory from a snapshot into dir and
+// returns its path
+func restoreToDir(ctx context.Context, r repo.Repository, entry fs.Entry, dir string) (string, error) {
+	target := filepath.Join(dir, entry.Name())
+	output := &restore.FilesystemOutput{TargetPath: target, SkipOwners: true}
+	if err := output.Init(ctx); err != nil {
+		return "", fmt.Errorf("preparing restore target: %w", err)
+	}
+	if _, err := restore.Entry(ctx, r, output, entry, restore.Options{
+		RestoreDirEntryAtDepth: math.MaxInt32,
+	}); err != nil {
+		return "", fmt.Errorf("restoring dump %s: %w", entry.Name(), err)
+	}
+	return target, nil
+}
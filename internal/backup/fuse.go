@@ -0,0 +1,11 @@
+//go:build !linux
+
+package backup
+
+import "github.com/kopia/kopia/fs"
+
+// mountFUSE is a stub for non-Linux systems, where snapshots are served over
+// WebDAV instead
+func mountFUSE(dir fs.Directory, mountPoint string) (*Mount, error) {
+	return nil, errFUSEUnsupported
+}
@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/avolut/backup/internal/utils"
+	gofusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/kopia/kopia/fs"
+)
+
+// fuseCacheTimeout is how long the kernel caches entries and attributes,
+// which never change in a snapshot
+var fuseCacheTimeout = time.Minute
+
+// mountFUSE mounts dir read-only at mountPoint. As root it mounts directly,
+// otherwise with fusermount.
+func mountFUSE(dir fs.Directory, mountPoint string) (*Mount, error) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return nil, errFUSEUnsupported
+	}
+	server, err := gofusefs.Mount(mountPoint, &fuseNode{entry: dir}, &gofusefs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      "avolut-backup",
+			Name:        "avolut",
+			Options:     []string{"ro", "noatime"},
+			DirectMount: true,
+		},
+		EntryTimeout:    &fuseCacheTimeout,
+		AttrTimeout:     &fuseCacheTimeout,
+		NegativeTimeout: &fuseCacheTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mounting %s: %w", mountPoint, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+	return &Mount{
+		Path: mountPoint,
+		unmount: func(ctx context.Context) error {
+			return server.Unmount()
+		},
+		done: done,
+	}, nil
+}
+
+// fuseNode is a file, directory or symlink of a mounted snapshot
+type fuseNode struct {
+	gofusefs.Inode
+	entry fs.Entry
+}
+
+var (
+	_ gofusefs.NodeGetattrer  = (*fuseNode)(nil)
+	_ gofusefs.NodeLookuper   = (*fuseNode)(nil)
+	_ gofusefs.NodeReaddirer  = (*fuseNode)(nil)
+	_ gofusefs.NodeOpener     = (*fuseNode)(nil)
+	_ gofusefs.NodeReadlinker = (*fuseNode)(nil)
+)
+
+func (n *fuseNode) Getattr(ctx context.Context, fh gofusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fuseAttr(&out.Attr, n.entry)
+	out.Ino = n.StableAttr().Ino
+	return gofusefs.OK
+}
+
+func (n *fuseNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofusefs.Inode, syscall.Errno) {
+	dir, ok := n.entry.(fs.Directory)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	child, err := dir.Child(ctx, name)
+	if errors.Is(err, fs.ErrEntryNotFound) || (err == nil && child == nil) {
+		return nil, syscall.ENOENT
+	}
+	if err != nil {
+		utils.Warnf("Warning: error looking up %s: %v", name, err)
+		return nil, syscall.EIO
+	}
+	fuseAttr(&out.Attr, child)
+	return n.NewInode(ctx, &fuseNode{entry: child}, gofusefs.StableAttr{Mode: fuseMode(child)}), gofusefs.OK
+}
+
+func (n *fuseNode) Readdir(ctx context.Context) (gofusefs.DirStream, syscall.Errno) {
+	dir, ok := n.entry.(fs.Directory)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	iter, err := dir.Iterate(ctx)
+	if err != nil {
+		utils.Warnf("Warning: error reading directory %s: %v", n.entry.Name(), err)
+		return nil, syscall.EIO
+	}
+	defer iter.Close()
+
+	var entries []fuse.DirEntry
+	for {
+		e, err := iter.Next(ctx)
+		if err != nil {
+			utils.Warnf("Warning: error reading directory %s: %v", n.entry.Name(), err)
+			return nil, syscall.EIO
+		}
+		if e == nil {
+			break
+		}
+		entries = append(entries, fuse.DirEntry{Name: e.Name(), Mode: fuseMode(e)})
+	}
+	return gofusefs.NewListDirStream(entries), gofusefs.OK
+}
+
+func (n *fuseNode) Open(ctx context.Context, flags uint32) (gofusefs.FileHandle, uint32, syscall.Errno) {
+	file, ok := n.entry.(fs.File)
+	if !ok {
+		return nil, 0, syscall.EISDIR
+	}
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	r, err := file.Open(ctx)
+	if err != nil {
+		utils.Warnf("Warning: error opening %s: %v", n.entry.Name(), err)
+		return nil, 0, syscall.EIO
+	}
+	return &fuseFile{reader: r}, fuse.FOPEN_KEEP_CACHE, gofusefs.OK
+}
+
+func (n *fuseNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	link, ok := n.entry.(fs.Symlink)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	target, err := link.Readlink(ctx)
+	if err != nil {
+		utils.Warnf("Warning: error reading symlink %s: %v", n.entry.Name(), err)
+		return nil, syscall.EIO
+	}
+	return []byte(target), gofusefs.OK
+}
+
+// fuseFile is an open file of a mounted snapshot
+type fuseFile struct {
+	mu     sync.Mutex
+	reader fs.Reader
+}
+
+var (
+	_ gofusefs.FileReader   = (*fuseFile)(nil)
+	_ gofusefs.FileReleaser = (*fuseFile)(nil)
+)
+
+func (f *fuseFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.reader.Seek(off, io.SeekStart); err != nil {
+		return nil, syscall.EIO
+	}
+	n, err := io.ReadFull(f.reader, dest)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), gofusefs.OK
+}
+
+func (f *fuseFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reader.Close()
+	return gofusefs.OK
+}
+
+// fuseMode returns the file type bits of e
+func fuseMode(e fs.Entry) uint32 {
+	switch e.(type) {
+	case fs.Directory:
+		return fuse.S_IFDIR
+	case fs.Symlink:
+		return fuse.S_IFLNK
+	default:
+		return fuse.S_IFREG
+	}
+}
+
+// fuseAttr fills the attributes of e, read-only
+func fuseAttr(a *fuse.Attr, e fs.Entry) {
+	a.Mode = fuseMode(e) | uint32(e.Mode().Perm()&0o555)
+	a.Size = uint64(e.Size())
+	a.Blocks = (a.Size + 511) / 512
+	a.Mtime = uint64(e.ModTime().Unix())
+	a.Atime, a.Ctime = a.Mtime, a.Mtime
+	a.Nlink = 1
+	a.Uid = e.Owner().UserID
+	a.Gid = e.Owner().GroupID
+}
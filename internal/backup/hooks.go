@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/avolut/backup/internal/utils"
+)
+
+// RunHooks runs the shell commands of a hook one after another and logs
+// their output. It stops at the first command that fails. A nil env keeps
+// the environment of the process.
+func RunHooks(ctx context.Context, name string, commands []string, env []string) error {
+	for _, command := range commands {
+		cmd := newCommand(ctx, "sh", "-c", command)
+		cmd.Env = env
+
+		output, err := cmd.CombinedOutput()
+		if out := strings.TrimSpace(string(output)); out != "" {
+			utils.Infof("%s hook %q output:\n%s", name, command, out)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %w", name, command, err)
+		}
+		utils.Infof("%s hook %q completed", name, command)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/kopia/kopia/repo/maintenance"
+	"github.com/kopia/kopia/snapshot/snapshotgc"
+)
+
+// MaintenanceResult is what a maintenance run of a repository reclaimed
+type MaintenanceResult struct {
+	Mode maintenance.Mode
+	// BytesBefore and BytesAfter are the sizes of all blobs in storage
+	// before and after the run
+	BytesBefore, BytesAfter int64
+	// UnusedContents and UnusedBytes are the contents no snapshot references
+	// any more, found by the snapshot garbage collection of full runs
+	UnusedContents uint32
+	UnusedBytes    int64
+}
+
+// Reclaimed returns the storage freed by the run. Compaction writes new
+// index blobs, so a run that deleted little can grow the storage, which
+// counts as nothing reclaimed.
+func (m MaintenanceResult) Reclaimed() int64 {
+	return max(m.BytesBefore-m.BytesAfter, 0)
+}
+
+// Maintain runs quick or full maintenance on a repository. Quick maintenance
+// compacts indexes, full maintenance also deletes contents and blobs no
+// snapshot references and rewrites sparse packs. Both are needed for good
+// performance and for deleted snapshots to free storage.
+func Maintain(ctx context.Context, r repo.Repository, full bool) (MaintenanceResult, error) {
+	result := MaintenanceResult{Mode: maintenance.ModeQuick}
+	if full {
+		result.Mode = maintenance.ModeFull
+	}
+
+	dr, ok := r.(repo.DirectRepository)
+	if !ok {
+		return result, fmt.Errorf("repository does not support maintenance")
+	}
+	var err error
+	if result.BytesBefore, err = storageSize(ctx, dr); err != nil {
+		return result, err
+	}
+
+	// Mirror snapshotmaintenance.Run, keeping the statistics of the snapshot
+	// garbage collection
+	if err := repo.DirectWriteSession(ctx, dr, repo.WriteSessionOptions{
+		Purpose: "Scheduled maintenance",
+	}, func(ctx context.Context, dw repo.DirectRepositoryWriter) error {
+		return maintenance.RunExclusive(ctx, dw, result.Mode, true, func(ctx context.Context, params maintenance.RunParameters) error {
+			if params.Mode == maintenance.ModeFull {
+				stats, err := snapshotgc.Run(ctx, dw, true, maintenance.SafetyFull, params.MaintenanceStartTime)
+				if err != nil {
+					return fmt.Errorf("collecting unused contents: %w", err)
+				}
+				result.UnusedContents, result.UnusedBytes = stats.UnusedCount, stats.UnusedBytes
+			}
+			return maintenance.Run(ctx, params, maintenance.SafetyFull)
+		})
+	}); err != nil {
+		return result, fmt.Errorf("running maintenance: %w", err)
+	}
+
+	if result.BytesAfter, err = storageSize(ctx, dr); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// storageSize returns the total size of the blobs of a repository
+func storageSize(ctx context.Context, dr repo.DirectRepository) (int64, error) {
+	blobs, err := blob.ListAllBlobs(ctx, dr.BlobReader(), "")
+	if err != nil {
+		return 0, fmt.Errorf("listing blobs: %w", err)
+	}
+	return blob.TotalLength(blobs), nil
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"gopkg.in/yaml.v3"
+)
+
+// mongoDumpName is the directory mongodump writes its output to
+const mongoDumpName = "mongodump"
+
+// isMongoDB reports whether db is a MongoDB database
+func isMongoDB(db config.Database) bool {
+	return db.Engine == engineMongoDB
+}
+
+// mongoCommand prepares a MongoDB tool connected and authenticated as
+// configured for db. The URI and password go into a config file in dir
+// instead of the command line, where other users could see them.
+func mongoCommand(ctx context.Context, db config.Database, dir, name string, args ...string) (*exec.Cmd, error) {
+	secrets := map[string]string{}
+	var connArgs []string
+	if db.URI != "" {
+		secrets["uri"] = db.URI
+	} else {
+		port := db.Port
+		if port == 0 {
+			port = 27017
+		}
+		connArgs = append(connArgs, "--host", db.Host, "--port", strconv.Itoa(port))
+		if db.User != "" {
+			connArgs = append(connArgs, "--username", db.User)
+			secrets["password"] = db.Password
+		}
+		if db.AuthDB != "" {
+			connArgs = append(connArgs, "--authenticationDatabase", db.AuthDB)
+		}
+	}
+
+	if len(secrets) > 0 {
+		data, err := yaml.Marshal(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("encoding %s config: %w", name, err)
+		}
+		configFile := filepath.Join(dir, name+".yaml")
+		if err := os.WriteFile(configFile, data, 0600); err != nil {
+			return nil, fmt.Errorf("writing %s config: %w", name, err)
+		}
+		connArgs = append(connArgs, "--config", configFile)
+	}
+
+	cmd := newCommand(ctx, name, append(connArgs, args...)...)
+	cmd.Env = commandEnv(db)
+	return cmd, nil
+}
+
+// mongoDump dumps db, or every database when no dbname is configured, into
+// dir/mongodump
+func mongoDump(ctx context.Context, db config.Database, dir string) error {
+	// Keep the credentials out of the snapshotted directory
+	secretsDir, err := makeTempDir(db.Name + "-mongo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(secretsDir)
+
+	args := []string{"--out", filepath.Join(dir, mongoDumpName)}
+	if db.DBName != "" {
+		args = append(args, "--db", db.DBName)
+	}
+	cmd, err := mongoCommand(ctx, db, secretsDir, "mongodump", args...)
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing mongodump: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// restoreMongo loads a mongodump directory with mongorestore. The dump is
+// restored from the snapshot to a temporary directory first.
+func restoreMongo(ctx context.Context, r repo.Repository, db config.Database, entry fs.Entry) error {
+	tmpDir, err := makeTempDir(db.Name + "-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	target, err := restoreToDir(ctx, r, entry, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := mongoCommand(ctx, db, tmpDir, "mongorestore", "--dir", target)
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing mongorestore: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+	"golang.org/x/net/webdav"
+)
+
+// errFUSEUnsupported is returned by mountFUSE where FUSE isn't available
+var errFUSEUnsupported = errors.New("FUSE is not supported on this system")
+
+// Mount is a snapshot exposed read-only, either mounted with FUSE or served
+// over WebDAV
+type Mount struct {
+	// Path is the mount point, or the URL of the WebDAV server
+	Path string
+	// WebDAV is set when the snapshot is served over WebDAV
+	WebDAV bool
+
+	unmount func(ctx context.Context) error
+	done    <-chan struct{}
+}
+
+// Unmount removes the mount or stops the WebDAV server
+func (m *Mount) Unmount(ctx context.Context) error {
+	return m.unmount(ctx)
+}
+
+// Done is closed once the mount is gone, also when it was unmounted from
+// outside with umount or fusermount -u
+func (m *Mount) Done() <-chan struct{} {
+	return m.done
+}
+
+// MountSnapshot exposes the files of a snapshot read-only at mountPoint with
+// FUSE. Where FUSE isn't available, e.g. without /dev/fuse or on macOS, the
+// snapshot is served over WebDAV on a random local port instead.
+func MountSnapshot(ctx context.Context, r repo.Repository, manifest *snapshot.Manifest, mountPoint string) (*Mount, error) {
+	root, err := snapshotfs.SnapshotRoot(r, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("opening snapshot: %w", err)
+	}
+	dir, ok := root.(fs.Directory)
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s is not a directory", manifest.ID)
+	}
+
+	m, err := mountFUSE(dir, mountPoint)
+	if err == nil {
+		return m, nil
+	}
+	utils.Warnf("Warning: mounting with FUSE failed, serving over WebDAV instead: %v", err)
+	return serveWebDAV(ctx, dir)
+}
+
+// serveWebDAV serves dir read-only over WebDAV on a random port of localhost
+func serveWebDAV(ctx context.Context, dir fs.Directory) (*Mount, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listening for WebDAV: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler: &webdav.Handler{
+			FileSystem: webdavFS{dir},
+			LockSystem: webdav.NewMemLS(),
+		},
+		ReadHeaderTimeout: 15 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			utils.Warnf("Warning: WebDAV server stopped: %v", err)
+		}
+	}()
+
+	return &Mount{
+		Path:    "http://" + l.Addr().String(),
+		WebDAV:  true,
+		unmount: srv.Shutdown,
+		done:    done,
+	}, nil
+}
+
+// webdavFS is a read-only webdav.FileSystem of a snapshot directory
+type webdavFS struct {
+	root fs.Directory
+}
+
+func (w webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (w webdavFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (w webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (w webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	e, err := w.find(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavFile{ctx: ctx, entry: e}, nil
+}
+
+func (w webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return w.find(ctx, name)
+}
+
+// find looks up the entry at a slash separated path below the root.
+// Symlinks can't be represented in WebDAV and are not found.
+func (w webdavFS) find(ctx context.Context, name string) (fs.Entry, error) {
+	var e fs.Entry = w.root
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		dir, ok := e.(fs.Directory)
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		child, err := dir.Child(ctx, part)
+		if errors.Is(err, fs.ErrEntryNotFound) || child == nil {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		e = child
+	}
+	if _, ok := e.(fs.Symlink); ok {
+		return nil, os.ErrNotExist
+	}
+	return e, nil
+}
+
+// webdavFile is an open file or directory of a webdavFS. webdav.File has no
+// context argument, so the one of the request is kept.
+type webdavFile struct {
+	ctx   context.Context
+	entry fs.Entry
+
+	mu     sync.Mutex
+	reader fs.Reader
+	iter   fs.DirectoryIterator
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	r, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(p)
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+// open opens the reader of the file on first use
+func (f *webdavFile) open() (fs.Reader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.reader != nil {
+		return f.reader, nil
+	}
+	file, ok := f.entry.(fs.File)
+	if !ok {
+		return nil, fmt.Errorf("%s is a directory", f.entry.Name())
+	}
+	r, err := file.Open(f.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", f.entry.Name(), err)
+	}
+	f.reader = r
+	return r, nil
+}
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, ok := f.entry.(fs.Directory)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a directory", f.entry.Name())
+	}
+	if f.iter == nil {
+		iter, err := dir.Iterate(f.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading directory %s: %w", f.entry.Name(), err)
+		}
+		f.iter = iter
+	}
+
+	var infos []os.FileInfo
+	for count <= 0 || len(infos) < count {
+		e, err := f.iter.Next(f.ctx)
+		if err != nil {
+			return infos, fmt.Errorf("reading directory %s: %w", f.entry.Name(), err)
+		}
+		if e == nil {
+			break
+		}
+		if _, ok := e.(fs.Symlink); !ok {
+			infos = append(infos, e)
+		}
+	}
+	return infos, nil
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *webdavFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.iter != nil {
+		f.iter.Close()
+	}
+	if f.reader != nil {
+		return f.reader.Close()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// Database engines. PostgreSQL is used when no engine is configured.
+const (
+	enginePostgres = "postgres"
+	engineMySQL    = "mysql"
+	engineMongoDB  = "mongodb"
+	engineSQLite   = "sqlite"
+	engineRedis    = "redis"
+)
+
+// isMySQL reports whether db is a MySQL or MariaDB database
+func isMySQL(db config.Database) bool {
+	return db.Engine == engineMySQL
+}
+
+// mysqlCommand prepares a MySQL client command connected and authenticated
+// as configured for db
+func mysqlCommand(ctx context.Context, db config.Database, name string, args ...string) *exec.Cmd {
+	port := db.Port
+	if port == 0 {
+		port = 3306
+	}
+	connArgs := []string{
+		"--host", db.Host,
+		"--port", fmt.Sprintf("%d", port),
+		"--user", db.User,
+	}
+	cmd := newCommand(ctx, name, append(connArgs, args...)...)
+	cmd.Env = mysqlEnv(db)
+	return cmd
+}
+
+// mysqlEnv returns the environment for MySQL tools: the password for
+// authentication, followed by the custom variables configured for the
+// database so they take precedence
+func mysqlEnv(db config.Database) []string {
+	env := append(os.Environ(), fmt.Sprintf("MYSQL_PWD=%s", db.Password))
+	for key, value := range db.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
+
+// mysqlDump dumps db including routines and triggers into file. The dump
+// creates the database itself, so it restores without selecting one.
+func mysqlDump(ctx context.Context, db config.Database, file string) error {
+	cmd := mysqlCommand(ctx, db, "mysqldump",
+		"--single-transaction",
+		"--routines",
+		"--triggers",
+		"--result-file", file,
+		"--databases", db.DBName,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing mysqldump: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// extractMySQLVersion extracts the "major.minor" version from mysqldump
+// --version output or a server version, e.g. "8.0" or "10.11" for MariaDB
+func extractMySQLVersion(version string) string {
+	// MariaDB and MySQL 5.x tools report the server version they belong to
+	// after "Distrib", e.g. "mysqldump  Ver 10.19 Distrib 10.11.6-MariaDB"
+	if matches := regexp.MustCompile(`Distrib\s+([0-9]+\.[0-9]+)`).FindStringSubmatch(version); len(matches) > 1 {
+		return matches[1]
+	}
+	// MySQL 8 tools: "mysqldump  Ver 8.0.36 for Linux on x86_64"
+	if matches := regexp.MustCompile(`Ver\s+([0-9]+\.[0-9]+)`).FindStringSubmatch(version); len(matches) > 1 {
+		return matches[1]
+	}
+	// Server versions: "8.0.36" or "10.11.6-MariaDB-1:10.11.6+maria~ubu2204"
+	if matches := regexp.MustCompile(`^\s*([0-9]+\.[0-9]+)`).FindStringSubmatch(version); len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
+
+// olderMySQLVersion reports whether "major.minor" version a is older than b
+func olderMySQLVersion(a, b string) bool {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, _ := strconv.Atoi(pa[i])
+		nb, _ := strconv.Atoi(pb[i])
+		if na != nb {
+			return na < nb
+		}
+	}
+	return false
+}
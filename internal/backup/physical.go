@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// Database backup modes. Logical dumps are used when no mode is configured.
+const (
+	modeLogical  = "logical"
+	modePhysical = "physical"
+)
+
+// baseBackupName is the directory holding a physical backup in the snapshot
+const baseBackupName = "base"
+
+// isPhysical reports whether db is backed up with pg_basebackup
+func isPhysical(db config.Database) bool {
+	return db.Mode == modePhysical
+}
+
+// validateMode checks that the backup mode of db can be combined with its
+// other options
+func validateMode(db config.Database) error {
+	switch db.Mode {
+	case "", modeLogical:
+		return nil
+	case modePhysical:
+	default:
+		return fmt.Errorf("unknown backup mode %q, use %s or %s", db.Mode, modeLogical, modePhysical)
+	}
+
+	if isMySQL(db) || isMongoDB(db) || isSQLite(db) || isRedis(db) {
+		return fmt.Errorf("the %s mode is only supported for PostgreSQL", modePhysical)
+	}
+	if db.PerTable || db.SkipUnchanged || db.Format != "" || db.Compression != nil {
+		return fmt.Errorf("perTable, skipUnchanged, format and compression can't be used with the %s mode", modePhysical)
+	}
+	return nil
+}
+
+// baseBackup copies the data directory of the whole server, including the
+// WAL streamed while copying, into dir/base. The result is a consistent
+// data directory that a PostgreSQL server of the same major version can
+// start from. The user needs the REPLICATION privilege.
+func baseBackup(ctx context.Context, db config.Database, dir string) error {
+	cmd := pgCommand(ctx, db, "pg_basebackup",
+		"--pgdata", filepath.Join(dir, baseBackupName),
+		"--format", "plain",
+		"--wal-method", "stream",
+		"--checkpoint", "fast",
+		"--no-password",
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing pg_basebackup: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/compression"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/policy"
+)
+
+// sourcePolicy translates a configured policy block into a kopia policy
+func sourcePolicy(p *config.Policy) (*policy.Policy, error) {
+	pol := &policy.Policy{}
+
+	if p.Compression != "" {
+		name := compression.Name(p.Compression)
+		if p.Compression != "none" && compression.ByName[name] == nil {
+			return nil, fmt.Errorf("unknown compression %q", p.Compression)
+		}
+		pol.CompressionPolicy.CompressorName = name
+	}
+	pol.CompressionPolicy.MinSize = p.CompressionMinSize
+	pol.FilesPolicy.IgnoreRules = p.Ignore
+	if p.Retention != nil {
+		pol.RetentionPolicy = *retentionPolicy(p.Retention)
+	}
+
+	return pol, nil
+}
+
+// withCompression fills in the global compression where p doesn't set its
+// own
+func withCompression(p *config.Policy, c *config.Compression) *config.Policy {
+	if c == nil {
+		return p
+	}
+
+	merged := config.Policy{}
+	if p != nil {
+		merged = *p
+	}
+	if merged.Compression == "" {
+		merged.Compression = c.Algorithm
+	}
+	if merged.CompressionMinSize == 0 {
+		merged.CompressionMinSize = c.MinSize
+	}
+	return &merged
+}
+
+// directoryPolicy merges the exclude list of a directory into its policy
+func directoryPolicy(dir config.Directory) *config.Policy {
+	if len(dir.Exclude) == 0 {
+		return dir.Policy
+	}
+
+	p := config.Policy{}
+	if dir.Policy != nil {
+		p = *dir.Policy
+	}
+	p.Ignore = append(append([]string{}, p.Ignore...), dir.Exclude...)
+	return &p
+}
+
+// applyPolicy stores the configured policy of src in the repository, or
+// removes a stored one when none is configured, and returns the policy tree
+// to snapshot src with. The policy is only rewritten when it changed.
+func applyPolicy(ctx context.Context, r repo.Repository, src snapshot.SourceInfo, p *config.Policy) (*policy.Tree, error) {
+	defined, err := policy.GetDefinedPolicy(ctx, r, src)
+	if err != nil && !errors.Is(err, policy.ErrPolicyNotFound) {
+		return nil, fmt.Errorf("loading policy of %v: %w", src, err)
+	}
+
+	var desired *policy.Policy
+	if p != nil {
+		if desired, err = sourcePolicy(p); err != nil {
+			return nil, fmt.Errorf("policy of %v: %w", src, err)
+		}
+	}
+
+	if !samePolicy(defined, desired) {
+		if err := repo.WriteSession(ctx, r, repo.WriteSessionOptions{
+			Purpose: "Set source policy",
+		}, func(ctx context.Context, w repo.RepositoryWriter) error {
+			if desired == nil {
+				return policy.RemovePolicy(ctx, w, src)
+			}
+			return policy.SetPolicy(ctx, w, src, desired)
+		}); err != nil {
+			return nil, fmt.Errorf("storing policy of %v: %w", src, err)
+		}
+	}
+
+	tree, err := policy.TreeForSource(ctx, r, src)
+	if err != nil {
+		return nil, fmt.Errorf("loading policy tree of %v: %w", src, err)
+	}
+	return tree, nil
+}
+
+// samePolicy compares the settings of two policies, ignoring their labels
+func samePolicy(a, b *policy.Policy) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	settings := func(p *policy.Policy) string {
+		c := *p
+		c.Labels = nil
+		js, _ := json.Marshal(&c)
+		return string(js)
+	}
+	return settings(a) == settings(b)
+}
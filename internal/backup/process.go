@@ -0,0 +1,9 @@
+//go:build !linux
+
+package backup
+
+import "os/exec"
+
+// killProcessGroup is a stub for non-Linux systems, where only cmd itself is
+// killed on cancellation
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+// uploadProgress passes the progress of kopia's uploader on to the progress
+// of the item being backed up
+type uploadProgress struct {
+	snapshotfs.NullUploadProgress
+	item *utils.ItemProgress
+}
+
+// newUploadProgress returns the progress for an uploader of the backup of ctx,
+// reporting nothing when ctx doesn't belong to a tracked item
+func newUploadProgress(ctx context.Context) snapshotfs.UploadProgress {
+	result := itemResult(ctx)
+	if result == nil || result.progress == nil {
+		return &snapshotfs.NullUploadProgress{}
+	}
+	return &uploadProgress{item: result.progress}
+}
+
+// Enabled makes the uploader estimate the size of the source
+func (p *uploadProgress) Enabled() bool {
+	return true
+}
+
+func (p *uploadProgress) EstimationParameters() snapshotfs.EstimationParameters {
+	return snapshotfs.EstimationParameters{
+		Type:              snapshotfs.EstimationTypeAdaptive,
+		AdaptiveThreshold: snapshotfs.AdaptiveEstimationThreshold,
+	}
+}
+
+func (p *uploadProgress) EstimatedDataSize(fileCount, totalBytes int64) {
+	p.item.EstimatedFiles.Store(fileCount)
+	p.item.EstimatedBytes.Store(totalBytes)
+}
+
+func (p *uploadProgress) HashedBytes(numBytes int64) {
+	p.item.HashedBytes.Add(numBytes)
+}
+
+// CachedFile counts unchanged files as read, they are done without hashing
+func (p *uploadProgress) CachedFile(path string, size int64) {
+	p.item.HashedBytes.Add(size)
+}
+
+func (p *uploadProgress) FinishedFile(path string, err error) {
+	p.item.Files.Add(1)
+}
+
+// reuseCounter wraps the progress of an uploader to count the bytes of
+// unchanged files taken over from the previous snapshot and the bytes that
+// had to be read and hashed
+type reuseCounter struct {
+	snapshotfs.UploadProgress
+	cached, hashed atomic.Int64
+}
+
+func (c *reuseCounter) CachedFile(path string, size int64) {
+	c.cached.Add(size)
+	c.UploadProgress.CachedFile(path, size)
+}
+
+func (c *reuseCounter) HashedBytes(numBytes int64) {
+	c.hashed.Add(numBytes)
+	c.UploadProgress.HashedBytes(numBytes)
+}
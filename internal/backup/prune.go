@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/maintenance"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/policy"
+	"github.com/kopia/kopia/snapshot/snapshotmaintenance"
+)
+
+// retentionPolicy converts the configured retention settings into a kopia
+// retention policy. Unset (zero) values don't retain anything on their own.
+func retentionPolicy(retention *config.Retention) *policy.RetentionPolicy {
+	optional := func(n int) *policy.OptionalInt {
+		if n <= 0 {
+			return nil
+		}
+		v := policy.OptionalInt(n)
+		return &v
+	}
+
+	return &policy.RetentionPolicy{
+		KeepLatest:  optional(retention.KeepLatest),
+		KeepDaily:   optional(retention.KeepDaily),
+		KeepWeekly:  optional(retention.KeepWeekly),
+		KeepMonthly: optional(retention.KeepMonthly),
+	}
+}
+
+// PruneSource is a source along with the retention that applies to it
+type PruneSource struct {
+	Source    snapshot.SourceInfo
+	Retention *config.Retention
+}
+
+// Prune applies the retention of every given source and returns the
+// snapshots that are expired. Unless dryRun is set, the expired snapshots are
+// deleted and full repository maintenance is run to reclaim their space.
+// Only the provided sources are considered, other sources stored in the same
+// repository are left untouched.
+func Prune(ctx context.Context, r repo.Repository, sources []PruneSource, dryRun bool) ([]*snapshot.Manifest, error) {
+	// Collect expired snapshots per source
+	var expired []*snapshot.Manifest
+	for _, ps := range sources {
+		snapshots, err := sourceSnapshots(ctx, r, ps.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		retentionPolicy(ps.Retention).ComputeRetentionReasons(snapshots)
+		for _, m := range snapshots {
+			if len(m.RetentionReasons) == 0 && len(m.Pins) == 0 {
+				expired = append(expired, m)
+			}
+		}
+	}
+
+	if dryRun || len(expired) == 0 {
+		return expired, nil
+	}
+
+	// Delete expired snapshot manifests
+	if err := repo.WriteSession(ctx, r, repo.WriteSessionOptions{
+		Purpose: "Prune snapshots",
+	}, func(ctx context.Context, w repo.RepositoryWriter) error {
+		for _, m := range expired {
+			if err := w.DeleteManifest(ctx, m.ID); err != nil {
+				return fmt.Errorf("deleting snapshot %v: %w", m.ID, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Run maintenance so that contents only referenced by deleted snapshots
+	// are garbage collected
+	dr, ok := r.(repo.DirectRepository)
+	if !ok {
+		return expired, fmt.Errorf("repository does not support maintenance")
+	}
+	if err := repo.DirectWriteSession(ctx, dr, repo.WriteSessionOptions{
+		Purpose: "Prune maintenance",
+	}, func(ctx context.Context, dw repo.DirectRepositoryWriter) error {
+		return snapshotmaintenance.Run(ctx, dw, maintenance.ModeFull, true, maintenance.SafetyFull)
+	}); err != nil {
+		return expired, fmt.Errorf("running maintenance: %w", err)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// redisDumpName is the name of the RDB file in the snapshot
+const redisDumpName = "dump.rdb"
+
+// isRedis reports whether db is a Redis server
+func isRedis(db config.Database) bool {
+	return db.Engine == engineRedis
+}
+
+// redisCommand prepares redis-cli connected and authenticated as configured
+// for db. The password is passed in REDISCLI_AUTH instead of the command
+// line, where other users could see it.
+func redisCommand(ctx context.Context, db config.Database, args ...string) *exec.Cmd {
+	port := db.Port
+	if port == 0 {
+		port = 6379
+	}
+	connArgs := []string{"-h", db.Host, "-p", strconv.Itoa(port)}
+	if db.User != "" {
+		connArgs = append(connArgs, "--user", db.User)
+	}
+	if db.TLS {
+		connArgs = append(connArgs, "--tls")
+		if db.SSLRootCert != "" {
+			connArgs = append(connArgs, "--cacert", db.SSLRootCert)
+		}
+	}
+	cmd := newCommand(ctx, "redis-cli", append(connArgs, args...)...)
+	cmd.Env = redisEnv(db)
+	return cmd
+}
+
+// redisEnv returns the environment for redis-cli: the password, followed by
+// the custom variables configured for the database so they take precedence
+func redisEnv(db config.Database) []string {
+	env := os.Environ()
+	if db.Password != "" {
+		env = append(env, fmt.Sprintf("REDISCLI_AUTH=%s", db.Password))
+	}
+	for key, value := range db.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return env
+}
+
+// redisVersion returns the version of the Redis server of db, e.g.
+// "Redis 7.2.4". redis-cli prints error replies like NOAUTH without failing,
+// so the reply is checked for the version instead.
+func redisVersion(ctx context.Context, db config.Database) (string, error) {
+	output, err := redisCommand(ctx, db, "INFO", "server").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("getting database version: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if version, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "redis_version:"); ok {
+			return "Redis " + version, nil
+		}
+	}
+	return "", fmt.Errorf("getting database version: %s", strings.TrimSpace(string(output)))
+}
+
+// redisDump pulls an RDB snapshot of the whole server of db into file.
+// redis-cli --rdb has the server write it as for a replica, so it is
+// consistent without touching the server's own dump file.
+func redisDump(ctx context.Context, db config.Database, file string) error {
+	if output, err := redisCommand(ctx, db, "--rdb", file).CombinedOutput(); err != nil {
+		return fmt.Errorf("executing redis-cli --rdb: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// checkRDB fails unless file starts like an RDB file
+func checkRDB(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("opening dump: %w", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 5)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "REDIS" {
+		return fmt.Errorf("%s is not an RDB file", file)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+)
+
+// remoteDir is where remote directories are mirrored. The copy is kept
+// between runs, so rsync only transfers changes and kopia sees stable files.
+const remoteDir = ".avolut/remote"
+
+// syncRemote mirrors a remote directory into the state directory with rsync
+// over ssh and returns the local copy
+func syncRemote(ctx context.Context, remote config.Remote, sshKey string) (string, error) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		return "", fmt.Errorf("rsync is required to back up %s: %w", remote.Destination(), err)
+	}
+
+	// Create the mirror directory
+	local, err := mirrorPath(remote)
+	if err != nil {
+		return "", fmt.Errorf("error getting absolute path: %v", err)
+	}
+	if err := os.MkdirAll(local, 0700); err != nil {
+		return "", fmt.Errorf("creating mirror directory: %w", err)
+	}
+
+	// Share one connection per host between the directories of a run
+	controlPath, err := filepath.Abs(".avolut/ssh-%C")
+	if err != nil {
+		return "", fmt.Errorf("error getting absolute path: %v", err)
+	}
+	ssh := []string{"ssh",
+		"-o", "BatchMode=yes",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + controlPath,
+		"-o", "ControlPersist=60",
+	}
+	if remote.Port != "" {
+		ssh = append(ssh, "-p", remote.Port)
+	}
+	if sshKey != "" {
+		ssh = append(ssh, "-i", sshKey)
+	}
+
+	utils.Infof("Copying %s:%s with rsync", remote.Destination(), remote.Path)
+	// --protect-args sends the path without the remote shell splitting it
+	cmd := newCommand(ctx, "rsync",
+		"--archive",
+		"--delete",
+		"--numeric-ids",
+		"--protect-args",
+		"--rsh", rshCommand(ssh),
+		remote.Destination()+":"+strings.TrimSuffix(remote.Path, "/")+"/",
+		local+"/",
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("rsync from %s failed: %w\nOutput: %s", remote.Destination(), err, string(output))
+	}
+	return local, nil
+}
+
+// mirrorPath returns the local copy of a remote directory, kept apart for
+// every user, host and port
+func mirrorPath(remote config.Remote) (string, error) {
+	name := remote.Destination()
+	if remote.Port != "" {
+		name += ":" + remote.Port
+	}
+	return filepath.Abs(filepath.Join(remoteDir, name, remote.Path))
+}
+
+// rshCommand joins the ssh command for --rsh. rsync splits it at spaces
+// unless quoted, so every argument is single-quoted with inner quotes
+// doubled, e.g. a key file in a directory with spaces.
+func rshCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", "''") + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+func TestMirrorPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"ssh://db1/srv/data", "db1/srv/data"},
+		{"ssh://backup@db1/srv/data", "backup@db1/srv/data"},
+		{"ssh://deploy@db1/srv/data", "deploy@db1/srv/data"},
+		{"ssh://backup@db1:2222/srv/data", "backup@db1:2222/srv/data"},
+		{"ssh://backup@[::1]:2222/srv/data", "backup@[::1]:2222/srv/data"},
+	}
+	for _, tt := range tests {
+		remote, _, err := config.ParseRemote(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mirrorPath(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := filepath.Abs(filepath.Join(remoteDir, filepath.FromSlash(tt.want)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("mirrorPath(%q) = %s, want %s", tt.path, got, want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/restore"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+type RestoreOptions struct {
+	// Overwrite replaces files and directories that already exist in the target
+	Overwrite bool
+	// SkipOwners keeps the restoring user as owner of restored files
+	SkipOwners bool
+}
+
+// LatestSnapshot returns the most recent complete snapshot of a source
+func LatestSnapshot(ctx context.Context, r repo.Repository, src snapshot.SourceInfo) (*snapshot.Manifest, error) {
+	snapshots, err := sourceSnapshots(ctx, r, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *snapshot.Manifest
+	for _, m := range snapshots {
+		if m.IncompleteReason != "" {
+			continue
+		}
+		if latest == nil || m.StartTime.After(latest.StartTime) {
+			latest = m
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no snapshots found for %v", src)
+	}
+
+	return latest, nil
+}
+
+// RestoreSnapshot writes the contents of a snapshot to the target directory,
+// restoring permissions, modification times and (unless skipped) ownership
+func RestoreSnapshot(ctx context.Context, r repo.Repository, manifest *snapshot.Manifest, target string, opts RestoreOptions) (restore.Stats, error) {
+	root, err := snapshotfs.SnapshotRoot(r, manifest)
+	if err != nil {
+		return restore.Stats{}, fmt.Errorf("opening snapshot %v: %w", manifest.ID, err)
+	}
+
+	output := &restore.FilesystemOutput{
+		TargetPath:           target,
+		OverwriteDirectories: opts.Overwrite,
+		OverwriteFiles:       opts.Overwrite,
+		OverwriteSymlinks:    opts.Overwrite,
+		SkipOwners:           opts.SkipOwners,
+	}
+	if err := output.Init(ctx); err != nil {
+		return restore.Stats{}, fmt.Errorf("preparing restore target: %w", err)
+	}
+
+	stats, err := restore.Entry(ctx, r, output, root, restore.Options{
+		// Restore the full tree rather than shallow placeholders
+		RestoreDirEntryAtDepth: math.MaxInt32,
+	})
+	if err != nil {
+		return stats, fmt.Errorf("restoring snapshot %v: %w", manifest.ID, err)
+	}
+	return stats, nil
+}
+
+// RestoreTable loads a single table from the latest per-table snapshot of db
+// back into the database, replacing the existing table
+func RestoreTable(ctx context.Context, r repo.Repository, db config.Database, table string) error {
+	manifest, root, err := latestDatabaseSnapshot(ctx, r, db)
+	if err != nil {
+		return err
+	}
+
+	entry, err := snapshotfs.GetNestedEntry(ctx, root, []string{"tables", tableFileName(table)})
+	if err != nil {
+		return fmt.Errorf("table %s not found in snapshot %v (was it taken with perTable enabled?): %w", table, manifest.ID, err)
+	}
+
+	// The dump drops and recreates the table, which fails while foreign keys
+	// of other tables point to it
+	referencing, err := referencingTables(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if len(referencing) > 0 {
+		return fmt.Errorf("table %s can't be restored on its own, foreign keys of %s reference it; restore the whole database instead", table, strings.Join(referencing, ", "))
+	}
+	if err := loadDump(ctx, db, entry); err != nil {
+		return err
+	}
+
+	// Verify the restored database is usable
+	if err := runPostRestoreChecks(ctx, db); err != nil {
+		return fmt.Errorf("verifying restore of table %s: %w", table, err)
+	}
+
+	utils.Infof("Restored table %s of database %s from snapshot %v", table, db.Name, manifest.ID)
+	return nil
+}
+
+// RestoreDatabase loads the latest snapshot of db into the database, which
+// is expected to be empty. Per-table snapshots are loaded table by table,
+// retrying tables that depend on others not loaded yet.
+func RestoreDatabase(ctx context.Context, r repo.Repository, db config.Database) error {
+	manifest, root, err := latestDatabaseSnapshot(ctx, r, db)
+	if err != nil {
+		return err
+	}
+
+	if entry, err := snapshotfs.GetNestedEntry(ctx, root, []string{mongoDumpName}); err == nil {
+		if err := restoreMongo(ctx, r, db, entry); err != nil {
+			return err
+		}
+	} else if entry, err := snapshotfs.GetNestedEntry(ctx, root, []string{sqliteDumpName}); err == nil {
+		if err := restoreSQLite(ctx, r, db, entry); err != nil {
+			return err
+		}
+	} else if entry, err := snapshotfs.GetNestedEntry(ctx, root, []string{dumpNames[formatPlain]}); err == nil {
+		if err := loadDump(ctx, db, entry); err != nil {
+			return err
+		}
+	} else if _, err := snapshotfs.GetNestedEntry(ctx, root, []string{redisDumpName}); err == nil {
+		return fmt.Errorf("snapshot %v is a Redis RDB file, restore it with --restore %v <dir> and copy %s into the data directory of the stopped Redis server", manifest.ID, manifest.ID, redisDumpName)
+	} else if _, err := snapshotfs.GetNestedEntry(ctx, root, []string{baseBackupName}); err == nil {
+		return fmt.Errorf("snapshot %v is a physical backup, restore it with --restore %v <data-dir> and start PostgreSQL on that directory", manifest.ID, manifest.ID)
+	} else if entry, err := archiveDump(ctx, root); err == nil {
+		if err := restoreArchive(ctx, r, db, entry); err != nil {
+			return err
+		}
+	} else {
+		tablesEntry, err := snapshotfs.GetNestedEntry(ctx, root, []string{"tables"})
+		if err != nil {
+			return fmt.Errorf("snapshot %v contains no dump: %w", manifest.ID, err)
+		}
+		tablesDir, ok := tablesEntry.(fs.Directory)
+		if !ok {
+			return fmt.Errorf("tables in snapshot %v is not a directory", manifest.ID)
+		}
+		pending, err := fs.GetAllEntries(ctx, tablesDir)
+		if err != nil {
+			return fmt.Errorf("listing table dumps: %w", err)
+		}
+
+		// Load tables in passes until no more progress is made, so tables
+		// referencing others through foreign keys load after them
+		for len(pending) > 0 {
+			var failed []fs.Entry
+			var lastErr error
+			for _, e := range pending {
+				if err := loadDump(ctx, db, e); err != nil {
+					failed = append(failed, e)
+					lastErr = err
+				}
+			}
+			if len(failed) == len(pending) {
+				return fmt.Errorf("loading %d table dumps: %w", len(failed), lastErr)
+			}
+			pending = failed
+		}
+		utils.Warnf("Warning: %s was restored from per-table dumps, objects other than tables (views, functions) are not restored", db.Name)
+	}
+
+	// Verify the restored database is usable
+	if err := runPostRestoreChecks(ctx, db); err != nil {
+		return fmt.Errorf("verifying restore of database %s: %w", db.Name, err)
+	}
+
+	utils.Infof("Restored database %s from snapshot %v", db.Name, manifest.ID)
+	return nil
+}
+
+// archiveDump returns the custom or directory dump stored in a snapshot
+func archiveDump(ctx context.Context, root fs.Entry) (fs.Entry, error) {
+	for _, format := range []string{formatCustom, formatDirectory} {
+		if entry, err := snapshotfs.GetNestedEntry(ctx, root, []string{dumpNames[format]}); err == nil {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("no custom or directory dump found")
+}
+
+// latestDatabaseSnapshot returns the latest snapshot of db with its root,
+// warning when it was dumped from a different server version
+func latestDatabaseSnapshot(ctx context.Context, r repo.Repository, db config.Database) (*snapshot.Manifest, fs.Entry, error) {
+	manifest, err := LatestSnapshot(ctx, r, DatabaseSource(db))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Warn when restoring into a different server version than was dumped
+	if dumped := snapshotTag(manifest, TagServerVersion); dumped != "" {
+		if version, err := databaseVersion(ctx, db); err == nil {
+			if current := serverMajorVersion(db, version); current != dumped {
+				utils.Warnf("Warning: dump was made from server version %s but the server runs version %s", dumped, current)
+			}
+		}
+	}
+
+	root, err := snapshotfs.SnapshotRoot(r, manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening snapshot %v: %w", manifest.ID, err)
+	}
+	return manifest, root, nil
+}
+
+// referencingTables lists the other tables of db with foreign keys to table
+func referencingTables(ctx context.Context, db config.Database, table string) ([]string, error) {
+	name := quoteIdentifier(dumpSchema(db)) + "." + quoteIdentifier(table)
+	query := fmt.Sprintf("SELECT DISTINCT conrelid::regclass::text FROM pg_constraint WHERE contype = 'f' AND confrelid = to_regclass('%s') AND conrelid <> confrelid ORDER BY 1;", strings.ReplaceAll(name, "'", "''"))
+	output, err := pgCommand(ctx, db, "psql",
+		"--dbname", db.DBName,
+		"--tuples-only",
+		"--no-align",
+		"--command", query,
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing foreign keys to table %s: %w", table, err)
+	}
+
+	var tables []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			tables = append(tables, line)
+		}
+	}
+	return tables, nil
+}
+
+// loadDump streams a SQL dump from a snapshot into psql
+func loadDump(ctx context.Context, db config.Database, entry fs.Entry) error {
+	file, ok := entry.(fs.File)
+	if !ok {
+		return fmt.Errorf("dump %s is not a file", entry.Name())
+	}
+
+	reader, err := file.Open(ctx)
+	if err != nil {
+		return fmt.Errorf("opening dump %s: %w", entry.Name(), err)
+	}
+	defer reader.Close()
+
+	// Load the dump in a single transaction so a failure leaves the database as is
+	cmd := pgCommand(ctx, db, "psql",
+		"--dbname", db.DBName,
+		"--set", "ON_ERROR_STOP=1",
+		"--single-transaction",
+		"--quiet",
+	)
+	if isMySQL(db) {
+		// MySQL dumps select their database themselves and can't be
+		// loaded in a single transaction
+		cmd = mysqlCommand(ctx, db, "mysql")
+	}
+	cmd.Stdin = reader
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("loading dump %s: %w\nOutput: %s", entry.Name(), err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// ItemResult collects what the backup of a single directory or database
+// produced. Unlike UploadedBytes it is not affected by backups running in
+// parallel.
+type ItemResult struct {
+	bytes atomic.Int64
+	// progress tracks the item while it runs, if set
+	progress *utils.ItemProgress
+
+	mu         sync.Mutex
+	snapshotID string
+	files      int64
+}
+
+type itemResultKey struct{}
+
+// WithItemResult returns a context whose backups record their outcome in the
+// returned result
+func WithItemResult(ctx context.Context) (context.Context, *ItemResult) {
+	result := &ItemResult{}
+	return context.WithValue(ctx, itemResultKey{}, result), result
+}
+
+func itemResult(ctx context.Context) *ItemResult {
+	result, _ := ctx.Value(itemResultKey{}).(*ItemResult)
+	return result
+}
+
+// recordSnapshot stores the snapshot created by the backup of ctx
+func recordSnapshot(ctx context.Context, id manifest.ID, stats snapshot.Stats) {
+	result := itemResult(ctx)
+	if result == nil {
+		return
+	}
+	result.mu.Lock()
+	defer result.mu.Unlock()
+	result.snapshotID = string(id)
+	result.files = int64(stats.TotalFileCount)
+}
+
+// Bytes returns the bytes uploaded so far
+func (r *ItemResult) Bytes() int64 {
+	return r.bytes.Load()
+}
+
+// Snapshot returns the ID and file count of the created snapshot, an empty ID
+// if none was created
+func (r *ItemResult) Snapshot() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.snapshotID, r.files
+}
@@ -0,0 +1,538 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/metrics"
+	"github.com/avolut/backup/internal/notify"
+	"github.com/avolut/backup/internal/repository"
+	"github.com/avolut/backup/internal/status"
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/repo"
+)
+
+// Engine runs backups of a loaded configuration. Keep one Engine for the life
+// of the process, write sessions left behind by a crashed process are only
+// recovered on its first run. Runs of an Engine must not overlap.
+type Engine struct {
+	// Dumper runs PostgreSQL logical dumps, pg_dump when nil
+	Dumper Dumper
+
+	sessionsRecovered bool
+}
+
+// Run backs up every source of cfg with a new Engine
+func Run(ctx context.Context, cfg *config.Config) (notify.Report, error) {
+	return new(Engine).Run(ctx, cfg, "")
+}
+
+// Run backs up the sources of the named set, or of all sets when setName is
+// empty. The report lists the outcome of every item and is also written to
+// the metrics, the run status and the notifications configured in cfg. The
+// error is set when the run failed as a whole, failed items only clear
+// Success in the report.
+func (e *Engine) Run(ctx context.Context, cfg *config.Config, setName string) (report notify.Report, err error) {
+	// Only back up the sources of the requested set
+	if setName != "" {
+		selected := *cfg
+		found := false
+		for _, set := range cfg.Sets {
+			if set.Name == setName {
+				selected.Directories, selected.Databases = set.Directories, set.Databases
+				found = true
+			}
+		}
+		if !found {
+			return report, fmt.Errorf("backup set %s not found in backup.yaml", setName)
+		}
+		cfg = &selected
+	}
+
+	// Report the outcome of the run, including runs that fail early
+	report = notify.Report{App: cfg.Name, Set: setName, StartTime: time.Now(), Success: true}
+	startBytes := UploadedBytes()
+	defer func() {
+		if err != nil {
+			report.Success = false
+			report.Error = err.Error()
+		}
+		report.EndTime = time.Now()
+		report.TotalBytes = UploadedBytes() - startBytes
+		if err := metrics.WriteTextfile(cfg.Metrics, report); err != nil {
+			utils.Warnf("Warning: error writing metrics: %v", err)
+		}
+		if err := status.Record(report); err != nil {
+			utils.Warnf("Warning: error recording run status: %v", err)
+		}
+		if err := notify.Send(ctx, cfg.Notifications, report); err != nil {
+			utils.Warnf("Warning: error sending notifications: %v", err)
+		}
+	}()
+
+	// Make sure the system clock is sane before timestamping snapshots
+	if err := checkClockSkew(cfg.ClockCheck); err != nil {
+		return report, fmt.Errorf("checking system clock: %w", err)
+	}
+
+	// Apply the configured log verbosity
+	if err := utils.SetLogLevel(cfg.LogLevel); err != nil {
+		utils.Warnf("Warning: %v", err)
+	}
+	if err := utils.SetLogFormat(cfg.LogFormat); err != nil {
+		utils.Warnf("Warning: %v", err)
+	}
+
+	// Tune upload parallelism across the run if enabled
+	SetAdaptiveUploads(cfg.AdaptiveUploads)
+	SetTempDir(cfg.TempDir)
+	SetSourceIdentity(cfg.Hostname, cfg.Username)
+
+	// Expand glob patterns and directory lists into the directories they
+	// match now, so directories created since the last run are included
+	dirs, err := ExpandDirectories(cfg.Directories)
+	if err != nil {
+		return report, err
+	}
+	expanded := *cfg
+	expanded.Directories = dirs
+	cfg = &expanded
+
+	// Initialize progress tracking
+	totalItems := len(cfg.Directories) + len(cfg.Databases)
+	utils.InitProgress(totalItems)
+	if setName != "" {
+		utils.Infof("Starting backup of set %s for %s", setName, cfg.Name)
+	} else {
+		utils.Infof("Starting backup for %s", cfg.Name)
+	}
+
+	// Initialize file backup repository
+	utils.Infof("Connecting to file repository...")
+	fileRepo, err := repository.ConnectToRepository(ctx, cfg, repository.ConfigFile, "files")
+	if err != nil {
+		return report, fmt.Errorf("connecting to file repository: %w", err)
+	}
+	defer func() {
+		if err := fileRepo.Close(ctx); err != nil {
+			utils.Warnf("Warning: error closing file repository: %v", err)
+		}
+	}()
+	utils.Infof("Successfully connected to file repository")
+
+	// Initialize database backup repository
+	utils.Infof("Connecting to database repository...")
+	dbRepo, err := repository.ConnectToRepository(ctx, cfg, repository.ConfigDB, "dbs")
+	if err != nil {
+		return report, fmt.Errorf("connecting to database repository: %w", err)
+	}
+	defer func() {
+		if err := dbRepo.Close(ctx); err != nil {
+			utils.Warnf("Warning: error closing database repository: %v", err)
+		}
+	}()
+	utils.Infof("Successfully connected to database repository")
+
+	// Clean up after a previous process that stopped in the middle of a backup
+	if !e.sessionsRecovered {
+		RecoverSessions(ctx, fileRepo, "file")
+		RecoverSessions(ctx, dbRepo, "database")
+		e.sessionsRecovered = true
+	}
+
+	// Run the pre-backup hooks, a failure aborts the run. The post-backup
+	// hooks run once the items are done, even if the backup failed.
+	var preHooks, postHooks []string
+	if cfg.Hooks != nil {
+		preHooks, postHooks = cfg.Hooks.PreBackup, cfg.Hooks.PostBackup
+	}
+	runPostHooks := func() {
+		if err := RunHooks(ctx, "postBackup", postHooks, nil); err != nil {
+			utils.Errorf("Error running post-backup hooks: %v", err)
+			report.Items = append(report.Items, notify.Item{Type: "hook", Name: "postBackup", Error: err.Error()})
+		}
+	}
+	if err := RunHooks(ctx, "preBackup", preHooks, nil); err != nil {
+		runPostHooks()
+		return report, err
+	}
+
+	// Collect the directories and databases to back up
+	var jobs []backupJob
+	for _, dir := range cfg.Directories {
+		dir.Tags = mergeTags(cfg.Tags, dir.Tags)
+		dir.Policy = withCompression(dir.Policy, cfg.Compression)
+		jobs = append(jobs, backupJob{
+			item:    notify.Item{Type: "directory", Name: dir.Path},
+			label:   fmt.Sprintf("Directory: %s", dir.Path),
+			timeout: itemTimeout(cfg, dir.Timeout),
+			run: func(ctx context.Context) error {
+				return BackupDir(ctx, fileRepo, dir, ownDirectories(cfg))
+			},
+		})
+	}
+	for _, db := range cfg.Databases {
+		db.Tags = mergeTags(cfg.Tags, db.Tags)
+		db.Policy = withCompression(db.Policy, cfg.Compression)
+		jobs = append(jobs, backupJob{
+			item:    notify.Item{Type: "database", Name: db.Name},
+			label:   fmt.Sprintf("Database: %s", db.Name),
+			timeout: itemTimeout(cfg, db.Timeout),
+			run: func(ctx context.Context) error {
+				return BackupDatabase(ctx, dbRepo, db, e.Dumper)
+			},
+		})
+	}
+
+	// Report the progress within long items while they run
+	stopProgress := reportProgress()
+
+	// Run them with a bounded number of workers, each item uses its own
+	// writer session
+	report.Items = make([]notify.Item, len(jobs))
+	workers := make(chan struct{}, max(cfg.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			report.Items[i] = runBackupJob(ctx, job)
+			logProgress()
+		}()
+	}
+	wg.Wait()
+	stopProgress()
+	runPostHooks()
+
+	// Summarize the failed items, failed hooks were logged already
+	hasErrors := false
+	for _, item := range report.Items {
+		if item.Success {
+			continue
+		}
+		hasErrors = true
+		if item.Type != "hook" {
+			utils.With("source", item.Name).Errorf("Failed %s %s: %s", item.Type, item.Name, item.Error)
+		}
+	}
+
+	// Remove snapshots that fell out of the retention
+	pruneAfterBackup(ctx, cfg, fileRepo, dbRepo)
+
+	report.Success = !hasErrors
+	if hasErrors {
+		utils.Infof("Backup completed for %s with some errors", cfg.Name)
+	} else {
+		utils.Infof("Backup completed successfully for %s", cfg.Name)
+	}
+	return report, nil
+}
+
+// SelectItems returns a copy of cfg that only backs up the named directories
+// and databases, looked up in the set setName or in all sets when it is
+// empty. cfg is returned as is when both lists are empty. Names that are not
+// configured are an error rather than a run that backs up nothing.
+func SelectItems(cfg *config.Config, setName string, dirs, dbs []string) (*config.Config, error) {
+	if len(dirs) == 0 && len(dbs) == 0 {
+		return cfg, nil
+	}
+
+	// Check the names against the items that would be backed up, with
+	// patterns and directory lists expanded
+	available := cfg.Directories
+	availableDBs := cfg.Databases
+	if setName != "" {
+		found := false
+		for _, set := range cfg.Sets {
+			if set.Name == setName {
+				available, availableDBs = set.Directories, set.Databases
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("backup set %s not found in backup.yaml", setName)
+		}
+	}
+	available, err := ExpandDirectories(available)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range dirs {
+		if !slices.ContainsFunc(available, func(d config.Directory) bool { return sameDirectory(d.Path, path) }) {
+			return nil, fmt.Errorf("directory %s is not configured", path)
+		}
+	}
+	for _, name := range dbs {
+		if !slices.ContainsFunc(availableDBs, func(db config.Database) bool { return db.Name == name }) {
+			return nil, fmt.Errorf("database %s is not configured", name)
+		}
+	}
+
+	selectDirs := func(list []config.Directory) []config.Directory {
+		list, _ = expandDirectories(list, false)
+		var selected []config.Directory
+		for _, d := range list {
+			if slices.ContainsFunc(dirs, func(path string) bool { return sameDirectory(d.Path, path) }) {
+				selected = append(selected, d)
+			}
+		}
+		return selected
+	}
+	selectDBs := func(list []config.Database) []config.Database {
+		var selected []config.Database
+		for _, db := range list {
+			if slices.Contains(dbs, db.Name) {
+				selected = append(selected, db)
+			}
+		}
+		return selected
+	}
+
+	selected := *cfg
+	selected.Directories, selected.Databases = selectDirs(cfg.Directories), selectDBs(cfg.Databases)
+	selected.Sets = make([]config.BackupSet, len(cfg.Sets))
+	for i, set := range cfg.Sets {
+		set.Directories, set.Databases = selectDirs(set.Directories), selectDBs(set.Databases)
+		selected.Sets[i] = set
+	}
+	return &selected, nil
+}
+
+// sameDirectory reports whether two configured directory paths name the same
+// directory
+func sameDirectory(a, b string) bool {
+	return a == b || filepath.Clean(a) == filepath.Clean(b)
+}
+
+// backupJob is a directory or database backed up by Run
+type backupJob struct {
+	item  notify.Item
+	label string
+	// timeout cancels run when it takes longer, unlimited when zero
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// itemTimeout returns the timeout of an item, its own if set and otherwise
+// the global one
+func itemTimeout(cfg *config.Config, timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return cfg.Timeout
+}
+
+// runBackupJob backs up one item and reports its outcome. A panic only fails
+// the item, since it runs on a worker goroutine.
+func runBackupJob(ctx context.Context, job backupJob) (item notify.Item) {
+	item = job.item
+	logger := utils.With("source", item.Name)
+	logger.Debugf("Starting backup of %s: %s", item.Type, item.Name)
+	progress := utils.UpdateProgress(job.label)
+
+	itemCtx, result := WithItemResult(ctx)
+	result.progress = progress
+	if job.timeout > 0 {
+		var cancel context.CancelFunc
+		itemCtx, cancel = context.WithTimeout(itemCtx, job.timeout)
+		defer cancel()
+	}
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return job.run(itemCtx)
+	}()
+	if err != nil && errors.Is(itemCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %w", job.timeout, err)
+	}
+	item.Bytes = result.Bytes()
+	item.SnapshotID, item.Files = result.Snapshot()
+
+	if err != nil {
+		item.Error = err.Error()
+		logger.Errorf("Error backing up %s %s: %v", item.Type, item.Name, err)
+	} else {
+		item.Success = true
+		logger.Debugf("Successfully backed up %s: %s", item.Type, item.Name)
+	}
+	utils.FinishProgress(job.label, err != nil)
+	return item
+}
+
+// logProgress logs the progress after every item in debug mode and otherwise
+// only a periodic summary, so runs with many items don't flood the log
+func logProgress() {
+	if utils.DebugEnabled() || utils.ProgressSummaryDue() {
+		utils.Infof("Progress: %s", utils.GetProgressStatus())
+	}
+}
+
+// progressInterval is how often reportProgress logs and records the progress
+const progressInterval = time.Minute
+
+// reportProgress logs the progress and records it for --status every
+// progressInterval until the returned function is called
+func reportProgress() (stop func()) {
+	record := func() {
+		if err := status.RecordProgress(utils.GetProgressStatus()); err != nil {
+			utils.Warnf("Warning: error recording progress: %v", err)
+		}
+	}
+	record()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				utils.Infof("Progress: %s", utils.GetProgressStatus())
+				record()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if err := status.ClearProgress(); err != nil {
+			utils.Warnf("Warning: %v", err)
+		}
+	}
+}
+
+// RecoverSessions re-indexes and closes write sessions that a crashed process
+// never committed, so they don't break the following backups
+func RecoverSessions(ctx context.Context, r repo.Repository, name string) {
+	sessions, err := repository.RecoverSessions(ctx, r)
+	if err != nil {
+		utils.Warnf("Warning: error recovering incomplete sessions in %s repository: %v", name, err)
+		return
+	}
+	for _, s := range sessions {
+		utils.Infof("Recovered incomplete session %s in %s repository (host %s, started %s): %d contents from %d packs",
+			s.ID, name, s.Host, s.StartTime.Format(time.RFC3339), s.Contents, s.Packs)
+	}
+}
+
+// PruneSources returns the directory and database sources managed by cfg
+// that have a retention, using the retention of their own policy if they have
+// one. Other sources in the same repositories are never pruned.
+func PruneSources(cfg *config.Config) (dirSources, dbSources []PruneSource, err error) {
+	retentionOf := func(p *config.Policy) *config.Retention {
+		if p != nil && p.Retention != nil {
+			return p.Retention
+		}
+		return cfg.Retention
+	}
+	dirs, err := ExpandDirectories(cfg.Directories)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range dirs {
+		src, err := DirectorySource(dir.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if retention := retentionOf(dir.Policy); retention != nil {
+			dirSources = append(dirSources, PruneSource{Source: src, Retention: retention})
+		}
+	}
+	for _, db := range cfg.Databases {
+		if retention := retentionOf(db.Policy); retention != nil {
+			dbSources = append(dbSources, PruneSource{Source: DatabaseSource(db), Retention: retention})
+		}
+	}
+	return dirSources, dbSources, nil
+}
+
+// pruneAfterBackup applies the retention to the sources of cfg once a run
+// finished, so expired snapshots don't accumulate between manual prunes
+func pruneAfterBackup(ctx context.Context, cfg *config.Config, fileRepo, dbRepo repo.Repository) {
+	dirSources, dbSources, err := PruneSources(cfg)
+	if err != nil {
+		utils.Warnf("Warning: error collecting sources to prune: %v", err)
+		return
+	}
+
+	for _, rs := range []struct {
+		r       repo.Repository
+		name    string
+		sources []PruneSource
+	}{
+		{fileRepo, "file", dirSources},
+		{dbRepo, "database", dbSources},
+	} {
+		if len(rs.sources) == 0 {
+			continue
+		}
+		expired, err := Prune(ctx, rs.r, rs.sources, false)
+		if err != nil {
+			utils.Warnf("Warning: error pruning %s repository: %v", rs.name, err)
+			continue
+		}
+		if len(expired) > 0 {
+			utils.Infof("Pruned %d expired snapshots from %s repository", len(expired), rs.name)
+		}
+	}
+}
+
+// checkClockSkew warns when the system clock is further off than allowed, and
+// fails if the clock check is configured to do so
+func checkClockSkew(check *config.ClockCheck) error {
+	if check == nil {
+		return nil
+	}
+
+	server := check.NTPServer
+	if server == "" {
+		server = "pool.ntp.org"
+	}
+	maxSkew := check.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = time.Minute
+	}
+
+	offset, err := utils.QueryClockOffset(server)
+	if err != nil {
+		utils.Warnf("Warning: could not check system clock: %v", err)
+		return nil
+	}
+
+	if offset.Abs() > maxSkew {
+		if check.Fail {
+			return fmt.Errorf("system clock is off by %s according to %s", offset.Round(time.Second), server)
+		}
+		utils.Warnf("Warning: system clock is off by %s according to %s, snapshot times will be wrong", offset.Round(time.Second), server)
+	}
+	return nil
+}
+
+// ownDirectories returns the configured directories holding dumps and
+// repositories, which are never backed up as part of a directory
+func ownDirectories(cfg *config.Config) []string {
+	var dirs []string
+	if cfg.TempDir != "" {
+		dirs = append(dirs, cfg.TempDir)
+	}
+	if cfg.Storage.Type == "filesystem" && cfg.Storage.Path != "" {
+		dirs = append(dirs, cfg.Storage.Path)
+	}
+	return dirs
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+func TestSelectItems(t *testing.T) {
+	root := t.TempDir()
+	for _, app := range []string{"shop", "blog"} {
+		if err := os.MkdirAll(filepath.Join(root, app, "data"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pattern := filepath.Join(root, "*", "data")
+	shop := filepath.Join(root, "shop", "data")
+
+	cfg := &config.Config{
+		Sets: []config.BackupSet{
+			{
+				Name:        config.DefaultSet,
+				Directories: []config.Directory{{Path: "/srv/a"}, {Path: "/srv/b"}},
+				Databases:   []config.Database{{Name: "main"}},
+			},
+			{
+				Name:        "nightly",
+				Directories: []config.Directory{{Path: pattern}},
+				Databases:   []config.Database{{Name: "analytics"}},
+			},
+		},
+	}
+	for _, set := range cfg.Sets {
+		cfg.Directories = append(cfg.Directories, set.Directories...)
+		cfg.Databases = append(cfg.Databases, set.Databases...)
+	}
+
+	tests := []struct {
+		set      string
+		dirs     []string
+		dbs      []string
+		wantDirs []string
+		wantDBs  []string
+		// wantSets are the directories and databases left in each set
+		wantSets [][]string
+		wantErr  bool
+	}{
+		{"", []string{"/srv/a"}, nil, []string{"/srv/a"}, nil, [][]string{{"/srv/a"}, nil}, false},
+		{"", []string{"/srv/b/"}, nil, []string{"/srv/b"}, nil, [][]string{{"/srv/b"}, nil}, false},
+		{"", nil, []string{"analytics"}, nil, []string{"analytics"}, [][]string{nil, {"analytics"}}, false},
+		{"", []string{"/srv/a"}, []string{"main"}, []string{"/srv/a"}, []string{"main"}, [][]string{{"/srv/a", "main"}, nil}, false},
+		// Directories matched by a pattern are selected by their path
+		{"", []string{shop}, nil, []string{shop}, nil, [][]string{nil, {shop}}, false},
+		{"nightly", []string{shop}, []string{"analytics"}, []string{shop}, []string{"analytics"}, [][]string{nil, {shop, "analytics"}}, false},
+		{"nightly", nil, []string{"main"}, nil, nil, nil, true},
+		{"weekly", nil, []string{"main"}, nil, nil, nil, true},
+		{"", []string{"/srv/c"}, nil, nil, nil, nil, true},
+		{"", nil, []string{"missing"}, nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		selected, err := SelectItems(cfg, tt.set, tt.dirs, tt.dbs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SelectItems(%q, %q, %q) error = %v, want error %v", tt.set, tt.dirs, tt.dbs, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var sets [][]string
+		for _, set := range selected.Sets {
+			sets = append(sets, itemNames(set.Directories, set.Databases))
+		}
+		if got := itemNames(selected.Directories, nil); !slices.Equal(got, tt.wantDirs) {
+			t.Errorf("SelectItems(%q, %q, %q) directories = %q, want %q", tt.set, tt.dirs, tt.dbs, got, tt.wantDirs)
+		}
+		if got := itemNames(nil, selected.Databases); !slices.Equal(got, tt.wantDBs) {
+			t.Errorf("SelectItems(%q, %q, %q) databases = %q, want %q", tt.set, tt.dirs, tt.dbs, got, tt.wantDBs)
+		}
+		if !slices.EqualFunc(sets, tt.wantSets, slices.Equal) {
+			t.Errorf("SelectItems(%q, %q, %q) sets = %q, want %q", tt.set, tt.dirs, tt.dbs, sets, tt.wantSets)
+		}
+	}
+
+	if selected, err := SelectItems(cfg, "", nil, nil); err != nil || selected != cfg {
+		t.Errorf("SelectItems without names = %p, %v, want the configuration itself", selected, err)
+	}
+}
+
+// itemNames lists the paths of dirs followed by the names of dbs
+func itemNames(dirs []config.Directory, dbs []config.Database) []string {
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Path)
+	}
+	for _, db := range dbs {
+		names = append(names, db.Name)
+	}
+	return names
+}
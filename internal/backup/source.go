@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// legacyHost is the host of every local source before sources used the
+// hostname of the machine
+const legacyHost = "localhost"
+
+// sourceHost and sourceUser override the hostname and $USER in the sources
+// of this machine
+var sourceHost, sourceUser string
+
+// SetSourceIdentity sets the host and user name recorded in the snapshot
+// sources of this machine. Empty values use the hostname and $USER.
+func SetSourceIdentity(host, user string) {
+	sourceHost, sourceUser = host, user
+}
+
+// localIdentity returns the host and user name of local sources
+func localIdentity() (host, user string) {
+	host, user = sourceHost, sourceUser
+	if host == "" {
+		if name, err := os.Hostname(); err == nil && name != "" {
+			host = name
+		} else {
+			host = legacyHost
+		}
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	return host, user
+}
+
+// sourceSnapshots lists the snapshots of src, including those taken under
+// the legacy localhost source of the same path so they are still restored
+// and pruned along with the newer ones
+func sourceSnapshots(ctx context.Context, r repo.Repository, src snapshot.SourceInfo) ([]*snapshot.Manifest, error) {
+	snapshots, err := snapshot.ListSnapshots(ctx, r, src)
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots of %v: %w", src, err)
+	}
+
+	host, _ := localIdentity()
+	if src.Host != host || host == legacyHost {
+		return snapshots, nil
+	}
+	legacy := snapshot.SourceInfo{Host: legacyHost, UserName: os.Getenv("USER"), Path: src.Path}
+	older, err := snapshot.ListSnapshots(ctx, r, legacy)
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots of %v: %w", legacy, err)
+	}
+	return append(snapshots, older...), nil
+}
+
+// previousSnapshots returns the snapshots of src the uploader can take
+// unchanged files over from: the latest complete snapshot and the incomplete
+// ones taken after it
+func previousSnapshots(ctx context.Context, r repo.Repository, src snapshot.SourceInfo) ([]*snapshot.Manifest, error) {
+	snapshots, err := sourceSnapshots(ctx, r, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var complete *snapshot.Manifest
+	for _, m := range snapshots {
+		if m.IncompleteReason == "" && (complete == nil || m.StartTime.After(complete.StartTime)) {
+			complete = m
+		}
+	}
+	var previous []*snapshot.Manifest
+	if complete != nil {
+		previous = append(previous, complete)
+	}
+	for _, m := range snapshots {
+		if m.IncompleteReason != "" && (complete == nil || m.StartTime.After(complete.StartTime)) {
+			previous = append(previous, m)
+		}
+	}
+	return previous, nil
+}
+
+// DirectorySource returns the snapshot source for a backed up directory
+func DirectorySource(dirPath string) (snapshot.SourceInfo, error) {
+	remote, isRemote, err := config.ParseRemote(dirPath)
+	if err != nil {
+		return snapshot.SourceInfo{}, err
+	}
+	if isRemote {
+		user := remote.User
+		if user == "" {
+			_, user = localIdentity()
+		}
+		return snapshot.SourceInfo{Host: remote.Host, UserName: user, Path: remote.Path}, nil
+	}
+
+	source, err := filepath.Abs(dirPath)
+	if err != nil {
+		return snapshot.SourceInfo{}, fmt.Errorf("error getting absolute path: %v", err)
+	}
+
+	host, user := localIdentity()
+	return snapshot.SourceInfo{
+		Host:     host,
+		UserName: user,
+		Path:     source,
+	}, nil
+}
+
+// DatabaseSource returns the snapshot source for a database. The path is
+// stable across runs so that every dump of a database shares one source.
+func DatabaseSource(db config.Database) snapshot.SourceInfo {
+	host, user := localIdentity()
+	return snapshot.SourceInfo{
+		Host:     host,
+		UserName: user,
+		Path:     "database/" + db.Name,
+	}
+}
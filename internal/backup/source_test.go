@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/repository"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// testRepository connects to a repository in filesystem storage, with its
+// configuration and cache in a temporary working directory
+func testRepository(t *testing.T) repo.Repository {
+	t.Helper()
+	ctx := context.Background()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	cfg := &config.Config{
+		Name:       "test",
+		Storage:    config.Storage{Type: "filesystem", Path: "storage"},
+		Repository: config.Repository{Password: "password"},
+	}
+	r, err := repository.ConnectToRepository(ctx, cfg, repository.ConfigDB, "dbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close(ctx) })
+	return r
+}
+
+// setSourceIdentity overrides the source identity for the test
+func setSourceIdentity(t *testing.T, host, user string) {
+	t.Helper()
+	SetSourceIdentity(host, user)
+	t.Cleanup(func() { SetSourceIdentity("", "") })
+}
+
+func TestSourceIdentity(t *testing.T) {
+	t.Setenv("USER", "alice")
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = legacyHost
+	}
+
+	tests := []struct {
+		host, user         string
+		wantHost, wantUser string
+	}{
+		{"", "", hostname, "alice"},
+		{"web1", "", "web1", "alice"},
+		{"", "backup", hostname, "backup"},
+		{"web1", "backup", "web1", "backup"},
+	}
+	for _, tt := range tests {
+		setSourceIdentity(t, tt.host, tt.user)
+
+		dir, err := DirectorySource("/srv/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := snapshot.SourceInfo{Host: tt.wantHost, UserName: tt.wantUser, Path: "/srv/data"}
+		if dir != want {
+			t.Errorf("SetSourceIdentity(%q, %q): DirectorySource() = %v, want %v", tt.host, tt.user, dir, want)
+		}
+		want.Path = "database/main"
+		if db := DatabaseSource(config.Database{Name: "main"}); db != want {
+			t.Errorf("SetSourceIdentity(%q, %q): DatabaseSource() = %v, want %v", tt.host, tt.user, db, want)
+		}
+	}
+
+	// Remote directories are recorded under the remote host, with the
+	// user of the connection or the local one
+	setSourceIdentity(t, "web1", "backup")
+	remotes := []struct {
+		path string
+		want snapshot.SourceInfo
+	}{
+		{"ssh://deploy@db1/srv/data", snapshot.SourceInfo{Host: "db1", UserName: "deploy", Path: "/srv/data"}},
+		{"ssh://db1/srv/data", snapshot.SourceInfo{Host: "db1", UserName: "backup", Path: "/srv/data"}},
+	}
+	for _, tt := range remotes {
+		got, err := DirectorySource(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("DirectorySource(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSourceSnapshotsIncludesLegacy(t *testing.T) {
+	ctx := context.Background()
+	r := testRepository(t)
+	t.Setenv("USER", "alice")
+
+	// Snapshots taken before sources had the hostname, after, and of another
+	// directory
+	legacy := snapshot.SourceInfo{Host: legacyHost, UserName: "alice", Path: "/srv/data"}
+	current := snapshot.SourceInfo{Host: "web1", UserName: "alice", Path: "/srv/data"}
+	other := snapshot.SourceInfo{Host: legacyHost, UserName: "alice", Path: "/srv/other"}
+	remote := snapshot.SourceInfo{Host: "db1", UserName: "alice", Path: "/srv/data"}
+	err := repo.WriteSession(ctx, r, repo.WriteSessionOptions{Purpose: "test"}, func(ctx context.Context, w repo.RepositoryWriter) error {
+		for _, src := range []snapshot.SourceInfo{legacy, current, current, other, remote} {
+			now := fs.UTCTimestampFromTime(time.Now())
+			if _, err := snapshot.SaveSnapshot(ctx, w, &snapshot.Manifest{Source: src, StartTime: now, EndTime: now}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		src  snapshot.SourceInfo
+		want int
+	}{
+		// The legacy snapshot belongs to the directory on this machine
+		{"web1", current, 3},
+		// Remote sources never had a legacy source
+		{"web1", remote, 1},
+		// Without a hostname the sources still are the legacy ones
+		{legacyHost, legacy, 1},
+	}
+	for _, tt := range tests {
+		setSourceIdentity(t, tt.host, "")
+		snapshots, err := sourceSnapshots(ctx, r, tt.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) != tt.want {
+			t.Errorf("host %s: sourceSnapshots(%v) = %d snapshots, want %d", tt.host, tt.src, len(snapshots), tt.want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package backup
+
+// allocatedSize returns the bytes actually allocated on disk for path
+func allocatedSize(path string) (int64, bool) {
+	return 0, false
+}
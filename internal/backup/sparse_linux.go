@@ -0,0 +1,19 @@
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the bytes actually allocated on disk for path
+func allocatedSize(path string) (int64, bool) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return 0, false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return stat.Blocks * 512, true
+}
@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+)
+
+// sqliteDumpName is the name of the database copy in the snapshot
+const sqliteDumpName = "database.sqlite"
+
+// isSQLite reports whether db is a SQLite database file
+func isSQLite(db config.Database) bool {
+	return db.Engine == engineSQLite
+}
+
+// sqliteBackup copies the database file of db into dir/database.sqlite with
+// the SQLite backup API. Unlike copying the file, the copy is consistent
+// while the application keeps writing.
+func sqliteBackup(ctx context.Context, db config.Database, dir string) error {
+	if _, err := os.Stat(db.Path); err != nil {
+		return fmt.Errorf("opening database file: %w", err)
+	}
+
+	// Run in dir so the target needs no quoting in the dot command
+	cmd := newCommand(ctx, "sqlite3", "-bail", db.Path, ".backup main "+sqliteDumpName)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing sqlite3 .backup: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// restoreSQLite writes a database copy from a snapshot back into the database
+// file of db with the SQLite backup API, so connected applications see the
+// restored contents instead of a replaced file
+func restoreSQLite(ctx context.Context, r repo.Repository, db config.Database, entry fs.Entry) error {
+	tmpDir, err := makeTempDir(db.Name + "-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := restoreToDir(ctx, r, entry, tmpDir); err != nil {
+		return err
+	}
+
+	cmd := newCommand(ctx, "sqlite3", "-bail", db.Path, ".restore main "+entry.Name())
+	cmd.Dir = tmpDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("executing sqlite3 .restore: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
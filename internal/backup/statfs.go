@@ -0,0 +1,8 @@
+//go:build !linux
+
+package backup
+
+// freeSpace is a stub for non-Linux systems, where the check is skipped
+func freeSpace(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,16 @@
+package backup
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the volume
+// of path
+func freeSpace(path string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false, fmt.Errorf("checking free space of %s: %w", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), true, nil
+}
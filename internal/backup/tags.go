@@ -0,0 +1,30 @@
+package backup
+
+import "maps"
+
+// userTagPrefix is the prefix kopia gives tags set by users, so configured
+// tags can be filtered on like those of kopia snapshot create --tags
+const userTagPrefix = "tag:"
+
+// internalTags are the snapshot tags recorded by the backup itself
+var internalTags = []string{TagServerVersion, TagDumpVersion, TagActivity, TagDumpSHA256, TagDumpSize}
+
+// mergeTags returns the global tags with those of an item added, replacing
+// global tags with the same key
+func mergeTags(global, item map[string]string) map[string]string {
+	if len(global) == 0 {
+		return item
+	}
+	tags := maps.Clone(global)
+	maps.Copy(tags, item)
+	return tags
+}
+
+// snapshotTags returns configured tags as snapshot tags
+func snapshotTags(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags))
+	for key, value := range tags {
+		result[userTagPrefix+key] = value
+	}
+	return result
+}
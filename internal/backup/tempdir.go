@@ -0,0 +1,32 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+)
+
+// tempDir holds the temporary directories of dumps and restores, the OS
+// temp directory when empty
+var tempDir string
+
+// SetTempDir sets the directory for temporary dumps and restores
+func SetTempDir(dir string) {
+	tempDir = dir
+}
+
+// makeTempDir creates a private directory below the temp directory for a
+// single dump or restore, which the caller removes when done
+func makeTempDir(name string) (string, error) {
+	base := tempDir
+	if base == "" {
+		base = os.TempDir()
+	}
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return "", fmt.Errorf("creating temp directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(base, "avolut-"+name+"-")
+	if err != nil {
+		return "", fmt.Errorf("creating temporary directory: %w", err)
+	}
+	return dir, nil
+}
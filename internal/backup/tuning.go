@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/avolut/backup/internal/utils"
+)
+
+const (
+	minTunedUploads = 2
+	maxTunedUploads = 32
+	// tuningMinBytes is the least amount of uploaded data a run needs for its
+	// throughput to be meaningful
+	tuningMinBytes = 64 << 20
+)
+
+// uploadTuner adapts upload parallelism to the measured throughput. It
+// starts conservative and ramps up after every upload that got faster,
+// settles on the best level once throughput stops improving and halves the
+// parallelism when an upload fails.
+type uploadTuner struct {
+	mu       sync.Mutex
+	enabled  bool
+	current  int
+	best     int
+	bestRate float64
+	settled  bool
+}
+
+var tuner = &uploadTuner{current: minTunedUploads, best: minTunedUploads}
+
+// SetAdaptiveUploads turns automatic tuning of upload parallelism on or off
+// for sources that don't set their parallelism explicitly
+func SetAdaptiveUploads(enabled bool) {
+	tuner.mu.Lock()
+	defer tuner.mu.Unlock()
+	tuner.enabled = enabled
+}
+
+// parallelism returns the parallel uploads to use, zero when tuning is off
+func (t *uploadTuner) parallelism() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.enabled {
+		return 0
+	}
+	return t.current
+}
+
+// record feeds the result of an upload made with the given parallelism
+func (t *uploadTuner) record(parallel int, uploaded int64, d time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.enabled || parallel != t.current {
+		return
+	}
+
+	if err != nil {
+		t.current = max(t.current/2, minTunedUploads)
+		t.best = min(t.best, t.current)
+		t.bestRate = 0
+		t.settled = false
+		utils.Infof("Upload failed, reducing parallel uploads to %d", t.current)
+		return
+	}
+	if uploaded < tuningMinBytes || d <= 0 {
+		return
+	}
+
+	rate := float64(uploaded) / d.Seconds()
+	switch {
+	case rate > t.bestRate*1.1:
+		// Still improving, keep ramping up
+		t.best, t.bestRate = t.current, rate
+		if !t.settled && t.current < maxTunedUploads {
+			t.current = min(t.current*2, maxTunedUploads)
+		}
+	case !t.settled:
+		// No real gain from more parallelism, go back to the best level
+		t.current = t.best
+		t.settled = true
+	}
+	utils.Infof("Measured upload throughput %.1f MB/s, using %d parallel uploads", rate/(1<<20), t.current)
+}
+
+// uploadedBytes sums the bytes uploaded by all backups of this process
+var uploadedBytes atomic.Int64
+
+// UploadedBytes returns the bytes uploaded by all backups of this process so
+// far. The difference before and after a backup is what it uploaded.
+func UploadedBytes() int64 {
+	return uploadedBytes.Load()
+}
+
+// uploadCounter sums the bytes uploaded by a write session
+type uploadCounter struct {
+	bytes atomic.Int64
+	// item is the result of the context the backup runs with, if any
+	item *ItemResult
+}
+
+func newUploadCounter(ctx context.Context) *uploadCounter {
+	return &uploadCounter{item: itemResult(ctx)}
+}
+
+func (c *uploadCounter) add(n int64) {
+	c.bytes.Add(n)
+	uploadedBytes.Add(n)
+	if c.item != nil {
+		c.item.bytes.Add(n)
+		if c.item.progress != nil {
+			c.item.progress.UploadedBytes.Add(n)
+		}
+	}
+}
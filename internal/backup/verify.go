@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/fs/localfs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+// Difference is a file that differs between a live directory and a snapshot
+type Difference struct {
+	Path string
+	// Kind is "added", "deleted" or "changed"
+	Kind string
+	// Reason tells what changed, e.g. "size" or "content"
+	Reason string
+}
+
+// CompareDir compares a live directory against its latest snapshot by name,
+// type, size and modification time, and by content when compareContent is
+// set. Files left out of the snapshot by policy show up as added.
+func CompareDir(ctx context.Context, r repo.Repository, dirPath string, compareContent bool) ([]Difference, error) {
+	if _, isRemote, _ := config.ParseRemote(dirPath); isRemote {
+		return nil, fmt.Errorf("%s is a remote directory, only local directories can be compared", dirPath)
+	}
+	src, err := DirectorySource(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := LatestSnapshot(ctx, r, src)
+	if err != nil {
+		return nil, err
+	}
+	root, err := snapshotfs.SnapshotRoot(r, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("opening snapshot %v: %w", manifest.ID, err)
+	}
+	live, err := localfs.Directory(src.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory entry: %w", err)
+	}
+
+	snapDir, ok := root.(fs.Directory)
+	if !ok {
+		return nil, fmt.Errorf("snapshot %v is not a directory", manifest.ID)
+	}
+
+	c := &comparer{compareContent: compareContent}
+	if err := c.compareDirs(ctx, snapDir, live, ""); err != nil {
+		return nil, err
+	}
+	return c.diffs, nil
+}
+
+type comparer struct {
+	compareContent bool
+	diffs          []Difference
+}
+
+func (c *comparer) add(p, kind, reason string) {
+	c.diffs = append(c.diffs, Difference{Path: p, Kind: kind, Reason: reason})
+}
+
+func (c *comparer) compareDirs(ctx context.Context, snap, live fs.Directory, dirPath string) error {
+	snapEntries, err := fs.GetAllEntries(ctx, snap)
+	if err != nil {
+		return fmt.Errorf("reading snapshot directory %q: %w", dirPath, err)
+	}
+	liveEntries, err := fs.GetAllEntries(ctx, live)
+	if err != nil {
+		return fmt.Errorf("reading directory %q: %w", dirPath, err)
+	}
+
+	snapByName := map[string]fs.Entry{}
+	for _, e := range snapEntries {
+		snapByName[e.Name()] = e
+	}
+
+	for _, le := range liveEntries {
+		p := path.Join(dirPath, le.Name())
+		se, ok := snapByName[le.Name()]
+		if !ok {
+			c.add(p, "added", "")
+			continue
+		}
+		delete(snapByName, le.Name())
+
+		if err := c.compareEntries(ctx, se, le, p); err != nil {
+			return err
+		}
+	}
+
+	for _, se := range snapEntries {
+		if _, ok := snapByName[se.Name()]; ok {
+			c.add(path.Join(dirPath, se.Name()), "deleted", "")
+		}
+	}
+	return nil
+}
+
+func (c *comparer) compareEntries(ctx context.Context, se, le fs.Entry, p string) error {
+	if se.Mode().Type() != le.Mode().Type() {
+		c.add(p, "changed", "type")
+		return nil
+	}
+
+	switch le := le.(type) {
+	case fs.Directory:
+		return c.compareDirs(ctx, se.(fs.Directory), le, p)
+	case fs.File:
+		switch {
+		case se.Size() != le.Size():
+			c.add(p, "changed", "size")
+		case !se.ModTime().Equal(le.ModTime()):
+			c.add(p, "changed", "mtime")
+		case c.compareContent:
+			same, err := sameContent(ctx, se.(fs.File), le)
+			if err != nil {
+				return fmt.Errorf("comparing %q: %w", p, err)
+			}
+			if !same {
+				c.add(p, "changed", "content")
+			}
+		}
+	case fs.Symlink:
+		snapTarget, err := se.(fs.Symlink).Readlink(ctx)
+		if err != nil {
+			return fmt.Errorf("reading snapshot symlink %q: %w", p, err)
+		}
+		liveTarget, err := le.Readlink(ctx)
+		if err != nil {
+			return fmt.Errorf("reading symlink %q: %w", p, err)
+		}
+		if snapTarget != liveTarget {
+			c.add(p, "changed", "target")
+		}
+	}
+	return nil
+}
+
+// sameContent compares two files by their SHA-256 hashes
+func sameContent(ctx context.Context, a, b fs.File) (bool, error) {
+	hashA, err := fileHash(ctx, a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := fileHash(ctx, b)
+	if err != nil {
+		return false, err
+	}
+	return hashA == hashB, nil
+}
+
+func fileHash(ctx context.Context, f fs.File) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	reader, err := f.Open(ctx)
+	if err != nil {
+		return sum, err
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -1,27 +1,117 @@
 package backup
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/snapshot"
 )
 
-// extractMajorVersion extracts the major version number from PostgreSQL version string
-func extractMajorVersion(version string) string {
-	// Handle pg_dump version string (e.g., "pg_dump (PostgreSQL) 14.2")
-	if strings.Contains(version, "pg_dump") {
-		re := regexp.MustCompile(`PostgreSQL[)\s]+([0-9]+)`)
-		matches := re.FindStringSubmatch(version)
-		if len(matches) > 1 {
-			return matches[1]
-		}
+// Snapshot tags recording the server and dump tool versions a dump was made
+// with, the major version for PostgreSQL and "major.minor" for MySQL
+const (
+	TagServerVersion = "tag:server-version"
+	TagDumpVersion   = "tag:dump-version"
+)
+
+// legacyTags are the names of the version tags in snapshots taken before
+// they applied to MySQL too
+var legacyTags = map[string]string{
+	TagServerVersion: "tag:pg-server-version",
+	TagDumpVersion:   "tag:pg-dump-version",
+}
+
+// snapshotTag returns a tag of m, falling back to its legacy name
+func snapshotTag(m *snapshot.Manifest, key string) string {
+	if value, ok := m.Tags[key]; ok {
+		return value
 	}
+	if legacy, ok := legacyTags[key]; ok {
+		return m.Tags[legacy]
+	}
+	return ""
+}
 
-	// Handle database version string (e.g., "PostgreSQL 14.2 on x86_64-apple-darwin...")
-	re := regexp.MustCompile(`PostgreSQL\s+([0-9]+)`)
-	matches := re.FindStringSubmatch(version)
-	if len(matches) > 1 {
-		return matches[1]
+// serverMajorVersion extracts the version used for compatibility checks from
+// a dump tool or server version string of the engine of db
+func serverMajorVersion(db config.Database, version string) string {
+	if isMySQL(db) {
+		return extractMySQLVersion(version)
 	}
+	return extractMajorVersion(version)
+}
 
-	return ""
+// checkVersions fails when the dump tool can't handle the server version,
+// given as extracted by serverMajorVersion. pg_dump must be at least as new
+// as the server, pg_basebackup the same major version.
+func checkVersions(db config.Database, dumpTool, dumpVersion, serverVersion string) error {
+	compatible := true
+	switch {
+	case isMongoDB(db), isSQLite(db), isRedis(db):
+		// No compatibility check needed
+	case isMySQL(db):
+		compatible = !olderMySQLVersion(dumpVersion, serverVersion)
+	case isPhysical(db):
+		compatible = dumpVersion == serverVersion
+	default:
+		// An unknown server version is let through, an unknown pg_dump isn't
+		cmp, ok := comparePGVersions(dumpVersion, serverVersion)
+		compatible = dumpVersion != "" && (!ok || cmp >= 0)
+	}
+	if !compatible {
+		return fmt.Errorf("version mismatch: %s version %s is not compatible with database version %s", dumpTool, dumpVersion, serverVersion)
+	}
+	return nil
+}
+
+// pgVersionPattern matches the version after "PostgreSQL" in the output of
+// pg_dump --version, pg_basebackup --version and SELECT version(), such as
+// "pg_dump (PostgreSQL) 16beta1" or "PostgreSQL 14.2 (Ubuntu 14.2-1.pgdg20.04+1)
+// on x86_64-pc-linux-gnu". Packaging details follow the version and are
+// ignored.
+var pgVersionPattern = regexp.MustCompile(`PostgreSQL\)?\s+([0-9]+)(?:\.([0-9]+))?`)
+
+// extractMajorVersion extracts the major version from a PostgreSQL version
+// string: "14" for 14.2 or 14rc1, and "9.6" for 9.6.24 since releases before
+// 10 had two-part major versions. It returns "" if there is no version.
+func extractMajorVersion(version string) string {
+	matches := pgVersionPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return ""
+	}
+	major, minor := matches[1], matches[2]
+	if n, err := strconv.Atoi(major); err == nil && n < 10 && minor != "" {
+		return major + "." + minor
+	}
+	return major
+}
+
+// comparePGVersions compares two major versions from extractMajorVersion,
+// returning false if either is not a version
+func comparePGVersions(a, b string) (int, bool) {
+	parse := func(v string) (major, minor int, ok bool) {
+		majorPart, minorPart, hasMinor := strings.Cut(v, ".")
+		major, err := strconv.Atoi(majorPart)
+		if err != nil {
+			return 0, 0, false
+		}
+		if hasMinor {
+			if minor, err = strconv.Atoi(minorPart); err != nil {
+				return 0, 0, false
+			}
+		}
+		return major, minor, true
+	}
+	aMajor, aMinor, aOK := parse(a)
+	bMajor, bMinor, bOK := parse(b)
+	if !aOK || !bOK {
+		return 0, false
+	}
+	if aMajor != bMajor {
+		return aMajor - bMajor, true
+	}
+	return aMinor - bMinor, true
 }
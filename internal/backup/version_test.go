@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func TestExtractMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		// pg_dump and pg_basebackup --version
+		{"pg_dump (PostgreSQL) 9.6.24", "9.6"},
+		{"pg_dump (PostgreSQL) 10.23", "10"},
+		{"pg_dump (PostgreSQL) 11.22", "11"},
+		{"pg_dump (PostgreSQL) 12.17", "12"},
+		{"pg_dump (PostgreSQL) 13.13", "13"},
+		{"pg_dump (PostgreSQL) 14.2", "14"},
+		{"pg_dump (PostgreSQL) 15.5", "15"},
+		{"pg_dump (PostgreSQL) 16.1", "16"},
+		{"pg_dump (PostgreSQL) 17.0", "17"},
+		{"pg_dump (PostgreSQL) 16beta1", "16"},
+		{"pg_dump (PostgreSQL) 15rc1", "15"},
+		{"pg_dump (PostgreSQL) 17devel", "17"},
+		{"pg_dump (PostgreSQL) 14.2 (Ubuntu 14.2-1.pgdg20.04+1)", "14"},
+		{"pg_dump (PostgreSQL) 15.4 (Debian 15.4-1.pgdg120+1)", "15"},
+		{"pg_dump (PostgreSQL) 14.10 (Homebrew)", "14"},
+		{"pg_basebackup (PostgreSQL) 16.1", "16"},
+		{"pg_basebackup (PostgreSQL) 9.6.24", "9.6"},
+
+		// SELECT version(), psql prints it with a leading space
+		{" PostgreSQL 9.6.24 on x86_64-pc-linux-gnu, compiled by gcc (Debian 6.3.0-18+deb9u1) 6.3.0 20170516, 64-bit\n", "9.6"},
+		{"PostgreSQL 10.23 on x86_64-pc-linux-gnu, compiled by gcc (GCC) 4.8.5 20150623 (Red Hat 4.8.5-44), 64-bit", "10"},
+		{"PostgreSQL 12.17 on x86_64-pc-linux-musl, compiled by gcc (Alpine 12.2.1_git20220924-r10) 12.2.1 20220924, 64-bit", "12"},
+		{"PostgreSQL 13.3, compiled by Visual C++ build 1914, 64-bit", "13"},
+		{"PostgreSQL 14.2 (Ubuntu 14.2-1.pgdg20.04+1) on x86_64-pc-linux-gnu, compiled by gcc (Ubuntu 9.3.0-17ubuntu1~20.04) 9.3.0, 64-bit", "14"},
+		{"PostgreSQL 15.4 (Debian 15.4-1.pgdg120+1) on aarch64-unknown-linux-gnu, compiled by gcc (Debian 12.2.0-14) 12.2.0, 64-bit", "15"},
+		{"PostgreSQL 16beta1 on x86_64-pc-linux-gnu, compiled by gcc (GCC) 13.1.1, 64-bit", "16"},
+		{"PostgreSQL 15rc1 (Ubuntu 15~rc1-1.pgdg22.04+1) on x86_64-pc-linux-gnu", "15"},
+		{"PostgreSQL 17.0 on aarch64-apple-darwin23.6.0, compiled by Apple clang version 15.0.0 (clang-1500.3.9.4), 64-bit", "17"},
+		{"PostgreSQL 9.4.26 (Greenplum Database 6.20.0 build commit:abc) on x86_64-unknown-linux-gnu", "9.4"},
+
+		// No version
+		{"", ""},
+		{"unknown", ""},
+		{"pg_dump: error: connection failed", ""},
+	}
+	for _, tt := range tests {
+		if got := extractMajorVersion(tt.version); got != tt.want {
+			t.Errorf("extractMajorVersion(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCheckVersions(t *testing.T) {
+	postgres := config.Database{}
+	physical := config.Database{Mode: modePhysical}
+	tests := []struct {
+		db      config.Database
+		dump    string
+		server  string
+		wantErr bool
+	}{
+		{postgres, "16", "16", false},
+		{postgres, "17", "14", false},
+		{postgres, "14", "16", true},
+		{postgres, "10", "9.6", false},
+		{postgres, "9.6", "10", true},
+		{postgres, "9.6", "9.5", false},
+		{postgres, "9.5", "9.6", true},
+		{postgres, "", "16", true},
+		{postgres, "16", "", false},
+		{physical, "16", "16", false},
+		{physical, "17", "16", true},
+		{physical, "9.6", "9.6", false},
+	}
+	for _, tt := range tests {
+		err := checkVersions(tt.db, "pg_dump", tt.dump, tt.server)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkVersions(mode %q, %q, %q) = %v, want error %v", tt.db.Mode, tt.dump, tt.server, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSnapshotTag(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		key  string
+		want string
+	}{
+		{map[string]string{TagServerVersion: "16"}, TagServerVersion, "16"},
+		{map[string]string{"tag:pg-server-version": "15"}, TagServerVersion, "15"},
+		{map[string]string{"tag:pg-dump-version": "8.0"}, TagDumpVersion, "8.0"},
+		{map[string]string{TagServerVersion: "16", "tag:pg-server-version": "15"}, TagServerVersion, "16"},
+		{map[string]string{TagDumpSize: "42"}, TagDumpSize, "42"},
+		{nil, TagServerVersion, ""},
+	}
+	for _, tt := range tests {
+		if got := snapshotTag(&snapshot.Manifest{Tags: tt.tags}, tt.key); got != tt.want {
+			t.Errorf("snapshotTag(%v, %s) = %q, want %q", tt.tags, tt.key, got, tt.want)
+		}
+	}
+}
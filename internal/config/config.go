@@ -1,19 +1,282 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Name        string     `yaml:"name"`
-	Directories []string   `yaml:"directories"`
-	Databases   []Database `yaml:"databases"`
-	Schedule    string     `yaml:"schedule"`
+	Name        string      `yaml:"name"`
+	Directories []Directory `yaml:"directories"`
+	Databases   []Database  `yaml:"databases"`
+	Schedule    string      `yaml:"schedule"`
+	Sets        []BackupSet `yaml:"sets"`
+	Storage     Storage     `yaml:"storage"`
+	Repository  Repository  `yaml:"repository"`
+	Cache       Cache       `yaml:"cache"`
+	Retention   *Retention  `yaml:"retention"`
+	ClockCheck  *ClockCheck `yaml:"clockCheck"`
+	// Timezone is the IANA time zone of the schedules, e.g. "Europe/Berlin".
+	// The local time zone of the host when unset.
+	Timezone string `yaml:"timezone"`
+	// LogLevel is "info" (default) for progress summaries or "debug" for a
+	// log line per backed up item
+	LogLevel string `yaml:"logLevel"`
+	// LogFormat is "text" (default) or "json" for one JSON object per line
+	LogFormat string `yaml:"logFormat"`
+	// Hostname and Username identify the snapshots of this machine in shared
+	// repositories, the system hostname and $USER when unset
+	Hostname string `yaml:"hostname"`
+	Username string `yaml:"username"`
+	// TempDir holds temporary database dumps, the OS temp directory when unset
+	TempDir string `yaml:"tempDir"`
+	// AdaptiveUploads tunes upload parallelism to the measured throughput for
+	// sources without an explicit parallelUploads
+	AdaptiveUploads bool `yaml:"adaptiveUploads"`
+	// Concurrency is the number of directories and databases backed up in
+	// parallel, default 1
+	Concurrency int `yaml:"concurrency"`
+	// Timeout limits the backup of each directory and database, which fails
+	// and has its commands killed when it runs longer. Unlimited when unset.
+	Timeout       time.Duration  `yaml:"timeout"`
+	Notifications *Notifications `yaml:"notifications"`
+	Metrics       *Metrics       `yaml:"metrics"`
+	Hooks         *Hooks         `yaml:"hooks"`
+	Resources     *Resources     `yaml:"resources"`
+	Retry         *Retry         `yaml:"retry"`
+	Maintenance   *Maintenance   `yaml:"maintenance"`
+	Compression   *Compression   `yaml:"compression"`
+	// Tags label every snapshot, e.g. env: prod, so snapshots can be told
+	// apart and filtered in a shared bucket. Directories and databases can
+	// add their own and replace these.
+	Tags map[string]string `yaml:"tags"`
+}
+
+// Maintenance has the daemon run repository maintenance on its own interval,
+// separate from the backup schedule
+type Maintenance struct {
+	// Interval is the time between maintenance runs, default 24h
+	Interval time.Duration `yaml:"interval"`
+	// Full runs full maintenance, which also deletes contents no snapshot
+	// references, instead of quick maintenance that only compacts indexes
+	Full bool `yaml:"full"`
+}
+
+// Compression sets how the contents of snapshots are compressed. A
+// compression in the policy of a directory or database replaces it.
+type Compression struct {
+	// Algorithm is a kopia compressor name, e.g. "zstd",
+	// "zstd-better-compression", "s2-default" or "none"
+	Algorithm string `yaml:"algorithm"`
+	// MinSize leaves files smaller than this many bytes uncompressed
+	MinSize int64 `yaml:"minSize"`
+}
+
+// Retry controls how storage requests that fail with timeouts, dropped
+// connections or server errors are retried
+type Retry struct {
+	// MaxAttempts is the number of tries per request, default 5
+	MaxAttempts int `yaml:"maxAttempts"`
+	// BaseDelay is the wait before the first retry, doubling with every
+	// further one, default 1s
+	BaseDelay time.Duration `yaml:"baseDelay"`
+}
+
+// Resources sets the scheduling priority of the backup process
+type Resources struct {
+	// Niceness is the CPU nice value from -20 to 19, default 19 (lowest)
+	Niceness *int `yaml:"niceness"`
+	// IOClass is the I/O scheduling class, "idle" or "best-effort", unchanged
+	// when unset
+	IOClass string `yaml:"ioClass"`
+	// CPUAffinity pins the process to these CPUs, all CPUs when empty
+	CPUAffinity []int `yaml:"cpuAffinity"`
+}
+
+// Hooks are shell commands run around a backup. A failing preBackup command
+// aborts the backup, postBackup commands run even if the backup failed.
+type Hooks struct {
+	PreBackup  []string `yaml:"preBackup"`
+	PostBackup []string `yaml:"postBackup"`
+}
+
+// Metrics configures the Prometheus textfile written after every run
+type Metrics struct {
+	// Textfile is the output path, default .avolut/metrics.prom. Point it into
+	// the directory of the node_exporter textfile collector.
+	Textfile string `yaml:"textfile"`
+}
+
+// Notifications reports the outcome of every backup run
+type Notifications struct {
+	// Webhook receives a JSON report of each run as a POST request
+	Webhook string `yaml:"webhook"`
+	// Timeout limits each delivery attempt, default 10s
+	Timeout time.Duration `yaml:"timeout"`
+	// Digest collects successful runs into one notification per interval,
+	// failed runs are still sent right away
+	Digest time.Duration `yaml:"digest"`
+	Slack  *Slack        `yaml:"slack"`
+	Email  *Email        `yaml:"email"`
+}
+
+// Email sends a summary of failed runs by SMTP
+type Email struct {
+	Host string `yaml:"host"`
+	// Port is the SMTP port, default 587, or 465 with tls: "tls"
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	// TLS is "starttls" (default) to upgrade the connection, "tls" for
+	// implicit TLS or "none" for plain SMTP, e.g. to a local relay
+	TLS string `yaml:"tls"`
+	// OnSuccess also sends an email for successful runs
+	OnSuccess bool `yaml:"onSuccess"`
+}
+
+// Slack posts a summary of each run to a Slack incoming webhook
+type Slack struct {
+	Webhook string `yaml:"webhook"`
+	// Channel overrides the default channel of the webhook
+	Channel string `yaml:"channel"`
+	// RepeatInterval holds back alerts for the same failures of a set until it
+	// has passed, default 6h
+	RepeatInterval time.Duration `yaml:"repeatInterval"`
+}
+
+// DefaultSet is the name of the set formed by the top-level schedule,
+// directories and databases
+const DefaultSet = "default"
+
+// BackupSet is a group of directories and databases with its own schedule
+type BackupSet struct {
+	Name        string      `yaml:"name"`
+	Schedule    string      `yaml:"schedule"`
+	Directories []Directory `yaml:"directories"`
+	Databases   []Database  `yaml:"databases"`
+}
+
+// ClockCheck compares the system clock against an NTP server before each
+// backup, since a wrong clock corrupts snapshot times and retention.
+type ClockCheck struct {
+	NTPServer string        `yaml:"ntpServer"`
+	MaxSkew   time.Duration `yaml:"maxSkew"`
+	// Fail aborts the backup instead of only logging a warning
+	Fail bool `yaml:"fail"`
+}
+
+type Storage struct {
+	// Type is "b2" (default), "s3" for any S3-compatible storage like MinIO,
+	// "gcs" for Google Cloud Storage or "filesystem" for a local directory
+	Type string `yaml:"type"`
+	// Region selects the B2 S3-compatible endpoint, e.g. "us-west-004", or
+	// the region passed to S3 storage
+	Region string `yaml:"region"`
+	// Endpoint overrides the S3-compatible endpoint host
+	Endpoint string `yaml:"endpoint"`
+	// Bucket, AccessKeyID and SecretAccessKey are required for S3 storage
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+	// Prefix is prepended to the object names in GCS storage
+	Prefix string `yaml:"prefix"`
+	// CredentialsFile is the service account JSON key for GCS storage, the
+	// application default credentials when unset
+	CredentialsFile string `yaml:"credentialsFile"`
+	// Path is the directory of filesystem storage, e.g. an NFS mount
+	Path string `yaml:"path"`
+	// DisableTLS connects to the S3 endpoint over plain HTTP
+	DisableTLS bool `yaml:"disableTLS"`
+	// MaxConcurrentRequests limits B2 requests in flight across all sources and
+	// repositories, zero is unlimited
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests"`
+	// MaxUploadMBps limits the upload rate in megabytes per second across all
+	// sources and repositories, zero is unlimited
+	MaxUploadMBps float64 `yaml:"maxUploadMBps"`
+}
+
+// Repository holds the password that encrypts the repositories. Changing it
+// requires new repositories, existing ones only open with their password.
+type Repository struct {
+	Password string `yaml:"password"`
+	// PasswordFile is read instead when password is unset
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+// Cache sets the local kopia cache sizes per repository. The metadata cache
+// holds indexes and directory listings, when unset it gets the content size.
+type Cache struct {
+	ContentCacheSizeBytes  int64 `yaml:"contentCacheSizeBytes"`
+	MetadataCacheSizeBytes int64 `yaml:"metadataCacheSizeBytes"`
+}
+
+// Retention controls how many snapshots are kept per source. Zero values
+// don't retain anything on their own.
+type Retention struct {
+	KeepLatest  int `yaml:"keepLatest"`
+	KeepDaily   int `yaml:"keepDaily"`
+	KeepWeekly  int `yaml:"keepWeekly"`
+	KeepMonthly int `yaml:"keepMonthly"`
+}
+
+// Directory is a directory to back up. It can be given as a plain path string
+// or as an object with per-directory options.
+type Directory struct {
+	// Path is a local path or ssh://user@host[:port]/path for a directory on
+	// another host, which is copied with rsync before the snapshot
+	Path string `yaml:"path"`
+	// SSHKey is the private key file for remote directories, the ssh defaults
+	// when unset
+	SSHKey string `yaml:"sshKey"`
+	// SkipSpecialFiles leaves out sockets, named pipes and device files
+	SkipSpecialFiles bool `yaml:"skipSpecialFiles"`
+	// SparseFiles detects sparse files: "warn" logs them, "skip" leaves them out
+	SparseFiles string `yaml:"sparseFiles"`
+	// Exclude holds gitignore-style globs of paths to leave out, e.g.
+	// "node_modules/" or "*.log"
+	Exclude []string `yaml:"exclude"`
+	// Timeout replaces the global timeout for this directory
+	Timeout time.Duration `yaml:"timeout"`
+	// Description overrides the default snapshot description
+	Description string `yaml:"description"`
+	// Tags are added to the global snapshot tags
+	Tags   map[string]string `yaml:"tags"`
+	Policy *Policy           `yaml:"policy"`
+}
+
+// Policy overrides the snapshot policy of a single directory or database.
+// It is stored in the repository, so kopia applies it to every snapshot.
+type Policy struct {
+	// Compression is a kopia compressor name, e.g. "zstd" or "none"
+	Compression string `yaml:"compression"`
+	// CompressionMinSize leaves files smaller than this many bytes
+	// uncompressed
+	CompressionMinSize int64 `yaml:"compressionMinSize"`
+	// Ignore holds gitignore-style rules of files to leave out
+	Ignore []string `yaml:"ignore"`
+	// Retention replaces the global retention for this source
+	Retention *Retention `yaml:"retention"`
+}
+
+func (d *Directory) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&d.Path)
+	}
+
+	type plain Directory
+	return value.Decode((*plain)(d))
 }
 
 type Database struct {
+	// Engine is "postgres" (default), "mysql" for MySQL and MariaDB,
+	// "mongodb", "sqlite" or "redis"
+	Engine   string `yaml:"engine"`
 	Name     string `yaml:"name"`
 	Host     string `yaml:"host"`
 	Port     int    `yaml:"port"`
@@ -21,7 +284,80 @@ type Database struct {
 	User     string `yaml:"user"`
 	Schema   string `yaml:"schema"`
 	Password string `yaml:"password"`
-	SSLMode  string `yaml:"sslmode"`
+	// URI is a MongoDB connection string used instead of host, port, user
+	// and password
+	URI string `yaml:"uri"`
+	// AuthDB is the MongoDB authentication database
+	AuthDB string `yaml:"authDB"`
+	// Path is the database file of a SQLite database
+	Path string `yaml:"path"`
+	// SSLMode is the libpq sslmode, e.g. "require" or "verify-full"
+	SSLMode string `yaml:"sslmode"`
+	// SSLRootCert is the CA certificate file used by verify-ca and verify-full,
+	// or to verify Redis servers with tls
+	SSLRootCert string `yaml:"sslrootcert"`
+	// TLS connects to a Redis server over TLS
+	TLS bool `yaml:"tls"`
+	// Description replaces "Backup of database <name>" before the versions
+	// in the snapshot description
+	Description string `yaml:"description"`
+	// Tags are added to the global snapshot tags
+	Tags map[string]string `yaml:"tags"`
+	// ParallelUploads sets kopia upload parallelism for multi-file dumps
+	ParallelUploads int `yaml:"parallelUploads"`
+	// PerTable dumps every table into its own file for granular restores
+	PerTable bool `yaml:"perTable"`
+	// IncludeTables limits a PostgreSQL dump to the matching tables, while
+	// ExcludeTables and ExcludeSchemas leave the matching ones out. They are
+	// pg_dump patterns like "audit_*" or "tenant_1.*".
+	IncludeTables  []string `yaml:"includeTables"`
+	ExcludeTables  []string `yaml:"excludeTables"`
+	ExcludeSchemas []string `yaml:"excludeSchemas"`
+	// Mode is "logical" (default) for pg_dump or "physical" to copy the whole
+	// server with pg_basebackup
+	Mode string `yaml:"mode"`
+	// Format is the pg_dump output format: "plain" (default), "custom" or
+	// "directory". Custom and directory dumps are restored with pg_restore.
+	Format string `yaml:"format"`
+	// Compression is the pg_dump compression level for custom and directory
+	// dumps, pg_dump's default when unset
+	Compression *int `yaml:"compression"`
+	// DiskHeadroom is the free space required on the temp volume before a
+	// dump, as a multiple of the database size. Default 1.2, or 0.5 for
+	// custom and directory dumps.
+	DiskHeadroom float64 `yaml:"diskHeadroom"`
+	// Jobs is the number of tables pg_dump dumps in parallel, only for
+	// directory dumps. Default 1.
+	Jobs int `yaml:"jobs"`
+	// RestoreJobs is the number of parallel pg_restore jobs, default 1
+	RestoreJobs int `yaml:"restoreJobs"`
+	// Env holds extra environment variables for pg_dump and psql, e.g. PGOPTIONS
+	Env map[string]string `yaml:"env"`
+	// SkipUnchanged reuses the previous snapshot instead of dumping when
+	// pg_stat_database shows no writes since then
+	SkipUnchanged bool `yaml:"skipUnchanged"`
+	// ConnectAttempts and ConnectInterval control how long a backup waits for
+	// a database that is not ready, 6 attempts 10s apart by default
+	ConnectAttempts int           `yaml:"connectAttempts"`
+	ConnectInterval time.Duration `yaml:"connectInterval"`
+	// PostRestoreChecks verify a restore, which fails if any of them fails
+	PostRestoreChecks []RestoreCheck `yaml:"postRestoreChecks"`
+	// Timeout replaces the global timeout for this database
+	Timeout time.Duration `yaml:"timeout"`
+	// Hooks run around the dump of this database with the connection
+	// settings in PGHOST, PGPORT, PGUSER, PGDATABASE and PGPASSWORD
+	Hooks  *Hooks  `yaml:"hooks"`
+	Policy *Policy `yaml:"policy"`
+}
+
+// RestoreCheck is a SQL statement or shell command run after a restore.
+// Commands get PGHOST, PGPORT, PGUSER, PGDATABASE and PGPASSWORD set, or
+// MYSQL_HOST, MYSQL_TCP_PORT and MYSQL_PWD for MySQL.
+type RestoreCheck struct {
+	SQL     string `yaml:"sql"`
+	Command string `yaml:"command"`
+	// Expect is compared against the trimmed output when set
+	Expect string `yaml:"expect"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -30,10 +366,63 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	// Substitute environment variables before decoding, so secrets can be
+	// injected at runtime and non-string fields can use them too
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if err := expandEnv(&root); err != nil {
+		return nil, err
+	}
+
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	if err := root.Decode(&config); err != nil {
 		return nil, err
 	}
+	config.mergeSets()
 
 	return &config, nil
 }
+
+// Location returns the time zone of the schedules
+func (c *Config) Location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", c.Timezone, err)
+	}
+	return loc, nil
+}
+
+// Scheduler returns a cron scheduler that parses schedules like validation
+// does and runs them in the configured time zone
+func (c *Config) Scheduler() (*cron.Cron, error) {
+	loc, err := c.Location()
+	if err != nil {
+		return nil, err
+	}
+	return cron.New(cron.WithParser(ScheduleParser), cron.WithLocation(loc)), nil
+}
+
+// mergeSets turns the top-level schedule, directories and databases into the
+// default set, then lists the directories and databases of every set at the
+// top level so commands that don't care about sets see all sources
+func (c *Config) mergeSets() {
+	if c.Schedule != "" || len(c.Directories) > 0 || len(c.Databases) > 0 {
+		c.Sets = append([]BackupSet{{
+			Name:        DefaultSet,
+			Schedule:    c.Schedule,
+			Directories: c.Directories,
+			Databases:   c.Databases,
+		}}, c.Sets...)
+	}
+
+	c.Directories, c.Databases = nil, nil
+	for _, set := range c.Sets {
+		c.Directories = append(c.Directories, set.Directories...)
+		c.Databases = append(c.Databases, set.Databases...)
+	}
+}
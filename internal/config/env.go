@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPattern matches ${VAR} and ${VAR:-default}
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces environment variable references in every scalar value
+// below node. The default is used when the variable is unset or empty, a
+// variable without default must be set.
+func expandEnv(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if !envPattern.MatchString(node.Value) {
+			return nil
+		}
+
+		var err error
+		node.Value = envPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			m := envPattern.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok && value != "" {
+				return value
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			if err == nil {
+				err = fmt.Errorf("line %d: environment variable %s is not set", node.Line, m[1])
+			}
+			return ""
+		})
+
+		// Let unquoted values resolve their type again, e.g. port: ${PG_PORT}
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+		return err
+	}
+
+	for _, child := range node.Content {
+		if err := expandEnv(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
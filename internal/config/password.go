@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PasswordEnv can hold the repository password instead of the configuration
+const PasswordEnv = "BACKUP_REPO_PASSWORD"
+
+// RepositoryPassword returns the password that encrypts the repositories,
+// taken from repository.password, repository.passwordFile or
+// BACKUP_REPO_PASSWORD in that order. There is no default, every install
+// needs its own.
+func (c *Config) RepositoryPassword() (string, error) {
+	if c.Repository.Password != "" {
+		return c.Repository.Password, nil
+	}
+	if c.Repository.PasswordFile != "" {
+		data, err := os.ReadFile(c.Repository.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("reading repository password: %w", err)
+		}
+		password := strings.TrimRight(string(data), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("repository password file %s is empty", c.Repository.PasswordFile)
+		}
+		return password, nil
+	}
+	if password := os.Getenv(PasswordEnv); password != "" {
+		return password, nil
+	}
+	return "", fmt.Errorf("repository password is required, set repository.password, repository.passwordFile or %s", PasswordEnv)
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Remote is a directory on another host, given as ssh://user@host[:port]/path
+type Remote struct {
+	User string
+	Host string
+	Port string
+	Path string
+}
+
+// ParseRemote parses an ssh:// directory path. It returns false for local
+// paths.
+func ParseRemote(path string) (Remote, bool, error) {
+	if !strings.HasPrefix(path, "ssh://") {
+		return Remote{}, false, nil
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return Remote{}, true, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if u.Hostname() == "" || u.Path == "" || u.Path == "/" {
+		return Remote{}, true, fmt.Errorf("%s needs a host and a path, e.g. ssh://user@host/srv/data", path)
+	}
+	// The path is mirrored below the state directory, so it must not leave it
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == ".." {
+			return Remote{}, true, fmt.Errorf("%s must not contain .. in its path", path)
+		}
+	}
+	return Remote{
+		User: u.User.Username(),
+		Host: u.Hostname(),
+		Port: u.Port(),
+		Path: u.Path,
+	}, true, nil
+}
+
+// Destination is the user@host argument for rsync, with an IPv6 address in
+// brackets so rsync can tell it from the path that follows
+func (r Remote) Destination() string {
+	host := r.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if r.User == "" {
+		return host
+	}
+	return r.User + "@" + host
+}
@@ -0,0 +1,45 @@
+package config
+
+import "testing"
+
+func TestParseRemote(t *testing.T) {
+	tests := []struct {
+		path            string
+		want            Remote
+		wantDestination string
+		wantRemote      bool
+		wantErr         bool
+	}{
+		{"/srv/data", Remote{}, "", false, false},
+		{"ssh://db1/srv/data", Remote{Host: "db1", Path: "/srv/data"}, "db1", true, false},
+		{"ssh://backup@db1:2222/srv/data", Remote{User: "backup", Host: "db1", Port: "2222", Path: "/srv/data"}, "backup@db1", true, false},
+		{"ssh://backup@10.0.0.5/srv/data", Remote{User: "backup", Host: "10.0.0.5", Path: "/srv/data"}, "backup@10.0.0.5", true, false},
+		{"ssh://10.0.0.5:22/srv/data", Remote{Host: "10.0.0.5", Port: "22", Path: "/srv/data"}, "10.0.0.5", true, false},
+		{"ssh://[::1]/srv/data", Remote{Host: "::1", Path: "/srv/data"}, "[::1]", true, false},
+		{"ssh://backup@[::1]:2222/srv/data", Remote{User: "backup", Host: "::1", Port: "2222", Path: "/srv/data"}, "backup@[::1]", true, false},
+		{"ssh://[fe80::1%25eth0]/srv/data", Remote{Host: "fe80::1%eth0", Path: "/srv/data"}, "[fe80::1%eth0]", true, false},
+		{"ssh://backup@[fe80::1%25eth0]:2222/srv/data", Remote{User: "backup", Host: "fe80::1%eth0", Port: "2222", Path: "/srv/data"}, "backup@[fe80::1%eth0]", true, false},
+		{"ssh://db1", Remote{}, "", true, true},
+		{"ssh://db1/", Remote{}, "", true, true},
+		{"ssh:///srv/data", Remote{}, "", true, true},
+		{"ssh://[::1/srv/data", Remote{}, "", true, true},
+		{"ssh://db1/srv/../etc", Remote{}, "", true, true},
+		{"ssh://db1/srv/data/..", Remote{}, "", true, true},
+		{"ssh://db1/srv/data..old", Remote{Host: "db1", Path: "/srv/data..old"}, "db1", true, false},
+	}
+	for _, tt := range tests {
+		got, isRemote, err := ParseRemote(tt.path)
+		if (err != nil) != tt.wantErr || isRemote != tt.wantRemote {
+			t.Errorf("ParseRemote(%q) = %v, %v, want remote %v and error %v", tt.path, isRemote, err, tt.wantRemote, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRemote(%q) = %+v, want %+v", tt.path, got, tt.want)
+		}
+		if tt.wantRemote && !tt.wantErr {
+			if dest := got.Destination(); dest != tt.wantDestination {
+				t.Errorf("ParseRemote(%q).Destination() = %q, want %q", tt.path, dest, tt.wantDestination)
+			}
+		}
+	}
+}
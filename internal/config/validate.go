@@ -0,0 +1,322 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kopia/kopia/repo/compression"
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduleParser parses backup schedules: five-field cron expressions, six
+// fields with leading seconds, and descriptors like @hourly, @daily or
+// @every 30m. The daemon schedules with it, so validation accepts exactly
+// what runs.
+var ScheduleParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// validSSLModes are the sslmode values of libpq
+var validSSLModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the configuration for missing or inconsistent settings.
+// It reports all problems at once as a *ValidationError.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Name == "" {
+		add("name is required")
+	}
+	if len(c.Sets) == 0 {
+		add("schedule is required")
+	}
+	if _, err := c.Location(); err != nil {
+		add("%v", err)
+	}
+	sets := map[string]bool{}
+	for _, set := range c.Sets {
+		name := set.Name
+		if name == "" {
+			add("every set needs a name")
+			name = "without name"
+		} else if sets[name] {
+			add("set name %s is used more than once", name)
+		}
+		sets[name] = true
+
+		if set.Schedule == "" {
+			add("set %s: schedule is required", name)
+		} else if _, err := ScheduleParser.Parse(set.Schedule); err != nil {
+			add("set %s: schedule %q is not a valid cron expression: %v", name, set.Schedule, err)
+		}
+	}
+
+	if c.Concurrency < 0 {
+		add("concurrency must not be negative")
+	}
+	if c.Timeout < 0 {
+		add("timeout must not be negative")
+	}
+	if c.Maintenance != nil && c.Maintenance.Interval < 0 {
+		add("maintenance: interval must not be negative")
+	}
+	if comp := c.Compression; comp != nil {
+		if comp.Algorithm == "" {
+			add("compression: algorithm is required")
+		} else if err := checkCompressor(comp.Algorithm); err != nil {
+			add("compression: %v", err)
+		}
+		if comp.MinSize < 0 {
+			add("compression: minSize must not be negative")
+		}
+	}
+	if n := c.Notifications; n != nil && n.Digest < 0 {
+		add("notifications: digest must not be negative")
+	}
+	if n := c.Notifications; n != nil && n.Email != nil {
+		e := n.Email
+		if e.Host == "" || e.From == "" || len(e.To) == 0 {
+			add("notifications: email needs host, from and to")
+		}
+		if e.Port < 0 || e.Port > 65535 {
+			add("notifications: email port %d is not valid", e.Port)
+		}
+		if e.TLS != "" && e.TLS != "starttls" && e.TLS != "tls" && e.TLS != "none" {
+			add("notifications: unknown email tls %q, use starttls, tls or none", e.TLS)
+		}
+	}
+	for _, problem := range tagProblems(c.Tags) {
+		add("tags: %s", problem)
+	}
+
+	switch c.Storage.Type {
+	case "", "b2":
+	case "s3":
+		if c.Storage.Endpoint == "" || c.Storage.Bucket == "" {
+			add("storage: endpoint and bucket are required for s3 storage")
+		}
+	case "gcs":
+		if c.Storage.Bucket == "" {
+			add("storage: bucket is required for gcs storage")
+		}
+	case "filesystem":
+		if c.Storage.Path == "" {
+			add("storage: path is required for filesystem storage")
+		}
+	default:
+		add("storage: unknown type %q, use b2, s3, gcs or filesystem", c.Storage.Type)
+	}
+
+	if r := c.Resources; r != nil {
+		if r.Niceness != nil && (*r.Niceness < -20 || *r.Niceness > 19) {
+			add("resources: niceness must be between -20 and 19")
+		}
+		if r.IOClass != "" && r.IOClass != "idle" && r.IOClass != "best-effort" {
+			add("resources: unknown ioClass %q, use idle or best-effort", r.IOClass)
+		}
+		for _, cpu := range r.CPUAffinity {
+			if cpu < 0 {
+				add("resources: cpuAffinity has negative CPU %d", cpu)
+			}
+		}
+	}
+	if _, err := c.RepositoryPassword(); err != nil {
+		add("%v", err)
+	}
+
+	dirs := map[string]bool{}
+	for i, dir := range c.Directories {
+		if dir.Path == "" {
+			add("directories[%d]: path is required", i)
+			continue
+		}
+		if _, isRemote, err := ParseRemote(dir.Path); err != nil {
+			add("directories[%d]: %v", i, err)
+		} else if _, err := filepath.Match(dir.Path, ""); !isRemote && err != nil {
+			add("directories[%d]: %s is not a valid glob pattern", i, dir.Path)
+		}
+		path := filepath.Clean(dir.Path)
+		if dirs[path] {
+			add("directories[%d]: %s is listed more than once", i, dir.Path)
+		}
+		dirs[path] = true
+		if dir.Timeout < 0 {
+			add("directories[%d]: timeout must not be negative", i)
+		}
+		if p := dir.Policy; p != nil {
+			if err := checkCompressor(p.Compression); p.Compression != "" && err != nil {
+				add("directories[%d]: policy: %v", i, err)
+			}
+			if p.CompressionMinSize < 0 {
+				add("directories[%d]: policy: compressionMinSize must not be negative", i)
+			}
+		}
+		for _, problem := range tagProblems(dir.Tags) {
+			add("directories[%d]: tags: %s", i, problem)
+		}
+	}
+
+	dbs := map[string]bool{}
+	for i, db := range c.Databases {
+		name := db.Name
+		if name == "" {
+			add("databases[%d]: name is required", i)
+			name = fmt.Sprintf("databases[%d]", i)
+		} else {
+			if dbs[db.Name] {
+				add("databases[%d]: name %s is used more than once", i, db.Name)
+			}
+			dbs[db.Name] = true
+		}
+
+		switch db.Engine {
+		case "redis":
+			if db.Host == "" {
+				add("database %s: host is required", name)
+			}
+			if db.Port < 0 || db.Port > 65535 {
+				add("database %s: port %d is not valid", name, db.Port)
+			}
+		case "sqlite":
+			if db.Path == "" {
+				add("database %s: path is required", name)
+			}
+		case "mongodb":
+			// MongoDB connects with a URI or a host, dumping all databases
+			// without dbname
+			if db.URI == "" && db.Host == "" {
+				add("database %s: uri or host is required", name)
+			}
+			if db.Port < 0 || db.Port > 65535 {
+				add("database %s: port %d is not valid", name, db.Port)
+			}
+		case "", "postgres", "mysql":
+			if db.Host == "" {
+				add("database %s: host is required", name)
+			}
+			if db.Port <= 0 || db.Port > 65535 {
+				add("database %s: port %d is not valid", name, db.Port)
+			}
+			if db.DBName == "" {
+				add("database %s: dbname is required", name)
+			}
+			if db.User == "" {
+				add("database %s: user is required", name)
+			}
+		default:
+			add("database %s: unknown engine %q, use postgres, mysql, mongodb, sqlite or redis", name, db.Engine)
+		}
+		switch db.Format {
+		case "", "plain", "custom", "directory":
+		default:
+			add("database %s: unknown format %q, use plain, custom or directory", name, db.Format)
+		}
+		switch db.Mode {
+		case "", "logical", "physical":
+		default:
+			add("database %s: unknown mode %q, use logical or physical", name, db.Mode)
+		}
+		switch {
+		case db.Jobs < 0:
+			add("database %s: jobs must not be negative", name)
+		case db.Jobs > 1 && db.Format != "directory":
+			// pg_dump only writes the directory format from several processes
+			add("database %s: jobs requires format: directory", name)
+		}
+		if db.SSLMode != "" {
+			switch {
+			case db.Engine == "mysql" || db.Engine == "mongodb" || db.Engine == "sqlite" || db.Engine == "redis":
+				add("database %s: sslmode is only supported for PostgreSQL", name)
+			case !validSSLModes[db.SSLMode]:
+				add("database %s: unknown sslmode %q, use disable, allow, prefer, require, verify-ca or verify-full", name, db.SSLMode)
+			}
+		}
+		if db.TLS && db.Engine != "redis" {
+			add("database %s: tls is only supported for Redis, use sslmode for PostgreSQL", name)
+		}
+		if db.Timeout < 0 {
+			add("database %s: timeout must not be negative", name)
+		}
+		if p := db.Policy; p != nil {
+			if err := checkCompressor(p.Compression); p.Compression != "" && err != nil {
+				add("database %s: policy: %v", name, err)
+			}
+			if p.CompressionMinSize < 0 {
+				add("database %s: policy: compressionMinSize must not be negative", name)
+			}
+		}
+		for _, problem := range tagProblems(db.Tags) {
+			add("database %s: tags: %s", name, problem)
+		}
+		if len(db.IncludeTables) > 0 && len(db.ExcludeTables) > 0 {
+			add("database %s: includeTables and excludeTables can't be combined", name)
+		}
+		if len(db.IncludeTables) > 0 || len(db.ExcludeTables) > 0 || len(db.ExcludeSchemas) > 0 {
+			switch {
+			case db.Engine == "mysql" || db.Engine == "mongodb" || db.Engine == "sqlite" || db.Engine == "redis":
+				add("database %s: includeTables, excludeTables and excludeSchemas are only supported for PostgreSQL", name)
+			case db.Mode == "physical" || db.PerTable:
+				add("database %s: includeTables, excludeTables and excludeSchemas are not supported with perTable or physical mode", name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// checkCompressor reports compressor names kopia doesn't support
+func checkCompressor(name string) error {
+	if name == "none" || compression.ByName[compression.Name(name)] != nil {
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, use a kopia compressor like zstd, zstd-better-compression, s2-default, gzip or none", name)
+}
+
+// reservedTags are the tags the backup records on snapshots itself, including
+// the version tags of older snapshots
+var reservedTags = map[string]bool{
+	"server-version":    true,
+	"dump-version":      true,
+	"pg-server-version": true,
+	"pg-dump-version":   true,
+	"pg-activity":       true,
+	"dump-sha256":       true,
+	"dump-size":         true,
+}
+
+// tagProblems returns what is wrong with configured snapshot tags
+func tagProblems(tags map[string]string) []string {
+	var problems []string
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		switch {
+		case key == "" || strings.Contains(key, ":"):
+			problems = append(problems, fmt.Sprintf("%q is not a valid tag name", key))
+		case reservedTags[key]:
+			problems = append(problems, fmt.Sprintf("%s is reserved for the tags of the backup", key))
+		}
+	}
+	return problems
+}
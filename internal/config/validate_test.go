@@ -0,0 +1,167 @@
+package config
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// validConfig returns a configuration that passes validation
+func validConfig() *Config {
+	return &Config{
+		Name:       "app",
+		Sets:       []BackupSet{{Name: DefaultSet, Schedule: "0 2 * * *"}},
+		Repository: Repository{Password: "secret"},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Setenv(PasswordEnv, "")
+	// connected fills in the connection settings required by postgres and mysql
+	connected := func(db Database) Database {
+		db.Host, db.Port, db.DBName, db.User = "localhost", 5432, "app", "app"
+		return db
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		// want is a part of the single expected problem, empty for none
+		want string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"no name", func(c *Config) { c.Name = "" }, "name is required"},
+		{"no sets", func(c *Config) { c.Sets = nil }, "schedule is required"},
+		{"set without schedule", func(c *Config) { c.Sets[0].Schedule = "" }, "set default: schedule is required"},
+		{"invalid schedule", func(c *Config) { c.Sets[0].Schedule = "every day" }, "not a valid cron expression"},
+		{"schedule with seconds", func(c *Config) { c.Sets[0].Schedule = "30 0 2 * * *" }, ""},
+		{"schedule descriptor", func(c *Config) { c.Sets[0].Schedule = "@daily" }, ""},
+		{"duplicate set", func(c *Config) { c.Sets = append(c.Sets, c.Sets[0]) }, "set name default is used more than once"},
+		{"unknown timezone", func(c *Config) { c.Timezone = "Mars/Olympus" }, "unknown timezone"},
+		{"timezone", func(c *Config) { c.Timezone = "Europe/Berlin" }, ""},
+		{"negative concurrency", func(c *Config) { c.Concurrency = -1 }, "concurrency must not be negative"},
+		{"no password", func(c *Config) { c.Repository.Password = "" }, "repository password is required"},
+		{"unknown storage", func(c *Config) { c.Storage.Type = "ftp" }, `unknown type "ftp"`},
+		{"s3 without bucket", func(c *Config) { c.Storage = Storage{Type: "s3", Endpoint: "minio:9000"} }, "endpoint and bucket are required"},
+		{"filesystem without path", func(c *Config) { c.Storage.Type = "filesystem" }, "path is required for filesystem storage"},
+		{"negative maintenance interval", func(c *Config) { c.Maintenance = &Maintenance{Interval: -1} }, "maintenance: interval must not be negative"},
+		{"compression", func(c *Config) { c.Compression = &Compression{Algorithm: "zstd-better-compression", MinSize: 4096} }, ""},
+		{"unknown compression", func(c *Config) { c.Compression = &Compression{Algorithm: "zstd-best"} }, `unknown compression "zstd-best"`},
+		{"compression without algorithm", func(c *Config) { c.Compression = &Compression{MinSize: 1} }, "compression: algorithm is required"},
+		{"reserved tag", func(c *Config) { c.Tags = map[string]string{"dump-size": "1"} }, "dump-size is reserved"},
+		{"invalid tag", func(c *Config) { c.Tags = map[string]string{"a:b": "1"} }, `"a:b" is not a valid tag name`},
+		{"negative digest", func(c *Config) { c.Notifications = &Notifications{Digest: -1} }, "digest must not be negative"},
+		{"email without recipients", func(c *Config) {
+			c.Notifications = &Notifications{Email: &Email{Host: "smtp", From: "backup@example.com"}}
+		}, "email needs host, from and to"},
+		{"unknown email tls", func(c *Config) {
+			c.Notifications = &Notifications{Email: &Email{Host: "smtp", From: "a@example.com", To: []string{"b@example.com"}, TLS: "ssl"}}
+		}, `unknown email tls "ssl"`},
+
+		{"directory", func(c *Config) { c.Directories = []Directory{{Path: "/srv/data"}} }, ""},
+		{"directory without path", func(c *Config) { c.Directories = []Directory{{}} }, "directories[0]: path is required"},
+		{"duplicate directory", func(c *Config) { c.Directories = []Directory{{Path: "/srv/data"}, {Path: "/srv/data/"}} }, "directories[1]: /srv/data/ is listed more than once"},
+		{"invalid glob", func(c *Config) { c.Directories = []Directory{{Path: "/srv/[a"}} }, "not a valid glob pattern"},
+		{"directory policy compression", func(c *Config) {
+			c.Directories = []Directory{{Path: "/srv/data", Policy: &Policy{Compression: "lzma"}}}
+		}, `directories[0]: policy: unknown compression "lzma"`},
+
+		{"postgres", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db"})} }, ""},
+		{"mysql", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db", Engine: "mysql"})} }, ""},
+		{"postgres without user", func(c *Config) {
+			db := connected(Database{Name: "db"})
+			db.User = ""
+			c.Databases = []Database{db}
+		}, "database db: user is required"},
+		{"unknown engine", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db", Engine: "postgresql"})} }, `unknown engine "postgresql"`},
+		{"sqlite", func(c *Config) { c.Databases = []Database{{Name: "db", Engine: "sqlite", Path: "/var/lib/app.db"}} }, ""},
+		{"sqlite without path", func(c *Config) { c.Databases = []Database{{Name: "db", Engine: "sqlite"}} }, "database db: path is required"},
+		{"mongodb uri", func(c *Config) { c.Databases = []Database{{Name: "db", Engine: "mongodb", URI: "mongodb://localhost"}} }, ""},
+		{"redis", func(c *Config) { c.Databases = []Database{{Name: "db", Engine: "redis", Host: "localhost"}} }, ""},
+		{"duplicate database", func(c *Config) {
+			c.Databases = []Database{connected(Database{Name: "db"}), connected(Database{Name: "db"})}
+		}, "databases[1]: name db is used more than once"},
+		{"unknown format", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db", Format: "tar"})} }, `unknown format "tar"`},
+		{"unknown mode", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db", Mode: "hot"})} }, `unknown mode "hot"`},
+		{"parallel directory dump", func(c *Config) {
+			c.Databases = []Database{connected(Database{Name: "db", Format: "directory", Jobs: 4})}
+		}, ""},
+		{"negative jobs", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db", Jobs: -1})} }, "jobs must not be negative"},
+		{"jobs without directory format", func(c *Config) {
+			c.Databases = []Database{connected(Database{Name: "db", Format: "custom", Jobs: 4})}
+		}, "jobs requires format: directory"},
+		{"unknown sslmode", func(c *Config) { c.Databases = []Database{connected(Database{Name: "db", SSLMode: "on"})} }, `unknown sslmode "on"`},
+		{"sslmode for mysql", func(c *Config) {
+			c.Databases = []Database{connected(Database{Name: "db", Engine: "mysql", SSLMode: "require"})}
+		}, "sslmode is only supported for PostgreSQL"},
+		{"include and exclude tables", func(c *Config) {
+			c.Databases = []Database{connected(Database{Name: "db", IncludeTables: []string{"a"}, ExcludeTables: []string{"b"}})}
+		}, "includeTables and excludeTables can't be combined"},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.change(c)
+		err := c.Validate()
+
+		var problems []string
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			problems = verr.Problems
+		} else if err != nil {
+			t.Errorf("%s: Validate() = %v, want a *ValidationError", tt.name, err)
+			continue
+		}
+
+		switch {
+		case tt.want == "" && len(problems) > 0:
+			t.Errorf("%s: Validate() = %q, want no problems", tt.name, problems)
+		case tt.want != "" && (len(problems) != 1 || !strings.Contains(problems[0], tt.want)):
+			t.Errorf("%s: Validate() = %q, want one problem containing %q", tt.name, problems, tt.want)
+		}
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	c := validConfig()
+	c.Name = ""
+	c.Concurrency = -1
+	c.Directories = []Directory{{}}
+
+	var verr *ValidationError
+	if err := c.Validate(); !errors.As(err, &verr) {
+		t.Fatalf("Validate() = %v, want a *ValidationError", err)
+	}
+	want := []string{"name is required", "concurrency must not be negative", "directories[0]: path is required"}
+	if !slices.Equal(verr.Problems, want) {
+		t.Errorf("Validate() problems = %q, want %q", verr.Problems, want)
+	}
+}
+
+func TestScheduleParser(t *testing.T) {
+	tests := []struct {
+		schedule string
+		wantErr  bool
+	}{
+		{"0 2 * * *", false},
+		{"*/15 * * * *", false},
+		{"30 2 * * mon-fri", false},
+		{"0 0 2 * * *", false},
+		{"*/10 * * * * *", false},
+		{"@hourly", false},
+		{"@daily", false},
+		{"@every 30m", false},
+		{"", true},
+		{"0 2 * *", true},
+		{"0 0 0 2 * * *", true},
+		{"60 2 * * *", true},
+		{"0 0 25 * * *", true},
+		{"@fortnightly", true},
+		{"daily", true},
+	}
+	for _, tt := range tests {
+		_, err := ScheduleParser.Parse(tt.schedule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ScheduleParser.Parse(%q) = %v, want error %v", tt.schedule, err, tt.wantErr)
+		}
+	}
+}
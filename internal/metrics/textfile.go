@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/notify"
+)
+
+// DefaultTextfile is where metrics are written when no path is configured
+const DefaultTextfile = ".avolut/metrics.prom"
+
+const lastSuccessMetric = "avolut_backup_last_success_timestamp_seconds"
+
+// WriteTextfile writes the outcome of a backup run in the Prometheus text
+// format, for the node_exporter textfile collector. The file is replaced
+// atomically so the collector never reads a partial file.
+func WriteTextfile(cfg *config.Metrics, report notify.Report) error {
+	path := DefaultTextfile
+	if cfg != nil && cfg.Textfile != "" {
+		path = cfg.Textfile
+	}
+	// Every set gets its own file so sets don't overwrite each other's metrics
+	if report.Set != "" {
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "-" + report.Set + ext
+	}
+
+	// A failed run keeps the time of the last successful one
+	lastSuccess := int64(previousValue(path, lastSuccessMetric))
+	if report.Success {
+		lastSuccess = report.EndTime.Unix()
+	}
+
+	labels := fmt.Sprintf(`app="%s"`, escape(report.App))
+	if report.Set != "" {
+		labels += fmt.Sprintf(`,set="%s"`, escape(report.Set))
+	}
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("avolut_backup_last_run_timestamp_seconds", "End time of the last backup run.")
+	fmt.Fprintf(&b, "avolut_backup_last_run_timestamp_seconds{%s} %d\n", labels, report.EndTime.Unix())
+	gauge(lastSuccessMetric, "End time of the last backup run without errors.")
+	fmt.Fprintf(&b, "%s{%s} %d\n", lastSuccessMetric, labels, lastSuccess)
+	gauge("avolut_backup_last_run_success", "Whether the last backup run finished without errors.")
+	fmt.Fprintf(&b, "avolut_backup_last_run_success{%s} %d\n", labels, boolValue(report.Success))
+	gauge("avolut_backup_last_duration_seconds", "Duration of the last backup run.")
+	fmt.Fprintf(&b, "avolut_backup_last_duration_seconds{%s} %g\n", labels, report.EndTime.Sub(report.StartTime).Seconds())
+	gauge("avolut_backup_last_uploaded_bytes", "Bytes uploaded by the last backup run.")
+	fmt.Fprintf(&b, "avolut_backup_last_uploaded_bytes{%s} %d\n", labels, report.TotalBytes)
+
+	gauge("avolut_backup_source_success", "Whether the source was backed up in the last run.")
+	for _, item := range report.Items {
+		fmt.Fprintf(&b, "avolut_backup_source_success{%s,type=\"%s\",source=\"%s\"} %d\n",
+			labels, item.Type, escape(item.Name), boolValue(item.Success))
+	}
+	gauge("avolut_backup_source_uploaded_bytes", "Bytes uploaded for the source in the last run.")
+	for _, item := range report.Items {
+		fmt.Fprintf(&b, "avolut_backup_source_uploaded_bytes{%s,type=\"%s\",source=\"%s\"} %d\n",
+			labels, item.Type, escape(item.Name), item.Bytes)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("creating metrics directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("writing metrics: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replacing metrics file: %w", err)
+	}
+	return nil
+}
+
+// previousValue reads a metric from an existing textfile, zero if missing
+func previousValue(path, metric string) float64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, metric+"{") {
+			continue
+		}
+		if i := strings.LastIndexByte(line, ' '); i >= 0 {
+			if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+// escape quotes a label value
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
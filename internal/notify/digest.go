@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// digestFile holds the successful runs waiting for the next digest, so they
+// survive restarts of the daemon and reach runs started by systemd timers
+const digestFile = ".avolut/notify-digest.json"
+
+// digestMu keeps the digest timer of the daemon from racing its runs
+var digestMu sync.Mutex
+
+// addToDigest stores a successful run until the next digest
+func addToDigest(report Report) error {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+
+	reports, err := loadDigest()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(append(reports, report))
+	if err != nil {
+		return fmt.Errorf("encoding digest: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(digestFile), 0755); err != nil {
+		return fmt.Errorf("creating digest directory: %w", err)
+	}
+	if err := os.WriteFile(digestFile, data, 0644); err != nil {
+		return fmt.Errorf("saving digest: %w", err)
+	}
+	return nil
+}
+
+// FlushDigest sends the collected runs as one digest once the first of them
+// is older than the digest interval. The runs are dropped after a failed
+// delivery, like a single report.
+func FlushDigest(ctx context.Context, cfg *config.Notifications) error {
+	if cfg == nil || cfg.Digest <= 0 {
+		return nil
+	}
+	digestMu.Lock()
+	defer digestMu.Unlock()
+
+	reports, err := loadDigest()
+	if err != nil || len(reports) == 0 || time.Since(reports[0].EndTime) < cfg.Digest {
+		return err
+	}
+	err = sendReport(ctx, cfg, digestReport(reports))
+	if rerr := os.Remove(digestFile); rerr != nil {
+		err = errors.Join(err, fmt.Errorf("removing digest: %w", rerr))
+	}
+	return err
+}
+
+func loadDigest() ([]Report, error) {
+	var reports []Report
+	data, err := os.ReadFile(digestFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading digest: %w", err)
+	}
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, fmt.Errorf("reading digest: %w", err)
+	}
+	return reports, nil
+}
+
+// digestReport combines successful runs into one report. Items are listed
+// once with the bytes of all runs and their latest snapshot.
+func digestReport(reports []Report) Report {
+	digest := Report{
+		App:       reports[0].App,
+		Set:       reports[0].Set,
+		Success:   true,
+		StartTime: reports[0].StartTime,
+		EndTime:   reports[len(reports)-1].EndTime,
+		Runs:      len(reports),
+	}
+	index := map[string]int{}
+	for _, report := range reports {
+		digest.TotalBytes += report.TotalBytes
+		if report.Set != digest.Set {
+			digest.Set = ""
+		}
+		for _, item := range report.Items {
+			key := item.Type + ":" + item.Name
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(digest.Items)
+				digest.Items = append(digest.Items, item)
+				continue
+			}
+			bytes := digest.Items[i].Bytes + item.Bytes
+			digest.Items[i] = item
+			digest.Items[i].Bytes = bytes
+		}
+	}
+	return digest
+}
@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+func TestDigestReport(t *testing.T) {
+	start := time.Date(2026, 10, 15, 2, 0, 0, 0, time.UTC)
+	run := func(set string, minutes int, items ...Item) Report {
+		r := Report{App: "app", Set: set, Success: true, Items: items,
+			StartTime: start.Add(time.Duration(minutes) * time.Minute), EndTime: start.Add(time.Duration(minutes+5) * time.Minute)}
+		for _, item := range items {
+			r.TotalBytes += item.Bytes
+		}
+		return r
+	}
+	dir := func(bytes int64, id string) Item {
+		return Item{Type: "directory", Name: "/srv/data", Success: true, Bytes: bytes, SnapshotID: id}
+	}
+	db := Item{Type: "database", Name: "main", Success: true, Bytes: 100, SnapshotID: "d1"}
+
+	tests := []struct {
+		reports []Report
+		want    Report
+	}{
+		{
+			[]Report{run("default", 0, dir(10, "a"))},
+			Report{App: "app", Set: "default", Success: true, Runs: 1, TotalBytes: 10,
+				StartTime: start, EndTime: start.Add(5 * time.Minute), Items: []Item{dir(10, "a")}},
+		},
+		{
+			[]Report{run("default", 0, dir(10, "a"), db), run("default", 15, dir(20, "b"))},
+			Report{App: "app", Set: "default", Success: true, Runs: 2, TotalBytes: 130,
+				StartTime: start, EndTime: start.Add(20 * time.Minute), Items: []Item{dir(30, "b"), db}},
+		},
+		// Runs of different sets make a digest of no single set
+		{
+			[]Report{run("default", 0, dir(10, "a")), run("nightly", 15, db)},
+			Report{App: "app", Success: true, Runs: 2, TotalBytes: 110,
+				StartTime: start, EndTime: start.Add(20 * time.Minute), Items: []Item{dir(10, "a"), db}},
+		},
+	}
+	for _, tt := range tests {
+		if got := digestReport(tt.reports); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("digestReport(%d runs) = %+v, want %+v", len(tt.reports), got, tt.want)
+		}
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	inTempDir(t)
+	ctx := context.Background()
+
+	var received []Report
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Error(err)
+		}
+		received = append(received, report)
+	}))
+	defer server.Close()
+	cfg := &config.Notifications{Webhook: server.URL, Digest: time.Hour}
+
+	// Recent successful runs wait for the digest, failures are sent at once
+	recent := Report{App: "app", Success: true, EndTime: time.Now()}
+	failed := Report{App: "app", EndTime: time.Now(), Error: "storage unreachable"}
+	old := recent
+	old.EndTime = time.Now().Add(-2 * time.Hour)
+
+	steps := []struct {
+		report *Report
+		// flush is the digest interval of a timer flush instead of a report
+		flush    time.Duration
+		wantRuns []int
+	}{
+		{&recent, 0, nil},
+		{&recent, 0, nil},
+		{&failed, 0, []int{0}},
+		// The timer of the daemon sends the digest once the first collected
+		// run is older than the interval
+		{nil, time.Hour, []int{0}},
+		{nil, time.Nanosecond, []int{0, 2}},
+		{&old, 0, []int{0, 2, 1}},
+		{&recent, 0, []int{0, 2, 1}},
+	}
+	for i, step := range steps {
+		var err error
+		if step.report != nil {
+			err = Send(ctx, cfg, *step.report)
+		} else {
+			err = FlushDigest(ctx, &config.Notifications{Webhook: server.URL, Digest: step.flush})
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		var runs []int
+		for _, report := range received {
+			runs = append(runs, report.Runs)
+		}
+		if !reflect.DeepEqual(runs, step.wantRuns) {
+			t.Errorf("step %d: received reports of %v runs, want %v", i, runs, step.wantRuns)
+		}
+	}
+
+	// The last run waits for the next digest
+	reports, err := loadDigest()
+	if err != nil || len(reports) != 1 {
+		t.Errorf("loadDigest() = %d runs, %v, want 1 run", len(reports), err)
+	}
+}
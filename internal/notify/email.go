@@ -0,0 +1,178 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+// errorTailLines is the number of lines of error output of every failed item
+// included in an email
+const errorTailLines = 20
+
+// emailNotifier sends the report as a plain text email over SMTP
+func emailNotifier(cfg *config.Email, timeout time.Duration) notifier {
+	return notifier{
+		name: "email",
+		payload: func(report Report) ([]byte, error) {
+			return emailMessage(cfg, report), nil
+		},
+		send: func(ctx context.Context, msg []byte) error {
+			return sendMail(ctx, cfg, timeout, msg)
+		},
+	}
+}
+
+// emailMessage formats the report as an email with headers. Failed items
+// come with the tail of their error output, so the failure can be triaged
+// without logging in to the host.
+func emailMessage(cfg *config.Email, report Report) []byte {
+	name := report.App
+	if report.Set != "" {
+		name += " (" + report.Set + ")"
+	}
+	result := "succeeded"
+	if !report.Success {
+		result = "FAILED"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	subject := fmt.Sprintf("Backup of %s %s", name, result)
+	if report.Runs > 0 {
+		subject = fmt.Sprintf("%d backups of %s succeeded", report.Runs, name)
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	var body strings.Builder
+	if report.Runs > 0 {
+		fmt.Fprintf(&body, "%d backups of %s succeeded, %s uploaded.\n", report.Runs, name, formatBytes(report.TotalBytes))
+	} else {
+		fmt.Fprintf(&body, "Backup of %s %s in %s, %s uploaded.\n", name, strings.ToLower(result),
+			report.EndTime.Sub(report.StartTime).Round(time.Second), formatBytes(report.TotalBytes))
+	}
+	fmt.Fprintf(&body, "Started %s, finished %s.\n\n", report.StartTime.Format(time.RFC3339), report.EndTime.Format(time.RFC3339))
+	if report.Error != "" {
+		fmt.Fprintf(&body, "The run failed: %s\n\n", report.Error)
+	}
+	for _, item := range report.Items {
+		if item.Success {
+			fmt.Fprintf(&body, "OK      %s %s (%s)\n", item.Type, item.Name, formatBytes(item.Bytes))
+		} else {
+			fmt.Fprintf(&body, "FAILED  %s %s\n", item.Type, item.Name)
+		}
+	}
+	for _, item := range report.Items {
+		if item.Success || item.Error == "" {
+			continue
+		}
+		fmt.Fprintf(&body, "\nError output of %s %s:\n%s\n", item.Type, item.Name, tail(item.Error, errorTailLines))
+	}
+
+	// The SMTP data writer turns the line endings into CRLF and escapes
+	// leading dots
+	b.WriteString(body.String())
+	return b.Bytes()
+}
+
+// tail returns the last n lines of s
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = append([]string{"..."}, lines[len(lines)-n:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendMail delivers msg over SMTP as configured. The whole exchange must
+// finish within timeout.
+func sendMail(ctx context.Context, cfg *config.Email, timeout time.Duration, msg []byte) error {
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+		if cfg.TLS == "tls" {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if cfg.TLS == "tls" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("starting SMTP session: %w", err)
+	}
+	defer c.Close()
+
+	if cfg.TLS == "" || cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't support STARTTLS, set tls to none to send without encryption", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starting TLS: %w", err)
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	if err := c.Mail(envelopeAddress(cfg.From)); err != nil {
+		return fmt.Errorf("setting sender: %w", err)
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(envelopeAddress(to)); err != nil {
+			return fmt.Errorf("adding recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("starting message: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("sending message: %w", err)
+	}
+	return c.Quit()
+}
+
+// envelopeAddress returns the bare address of "Name <user@host>"
+func envelopeAddress(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.Address
+	}
+	return addr
+}
@@ -0,0 +1,115 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+)
+
+func TestTail(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 3, ""},
+		{"one", 3, "one"},
+		{"one\ntwo\nthree", 3, "one\ntwo\nthree"},
+		{"one\ntwo\nthree\n", 3, "one\ntwo\nthree"},
+		{"one\ntwo\nthree\nfour", 2, "...\nthree\nfour"},
+		{"one\ntwo\nthree\n\n\n", 1, "...\nthree"},
+	}
+	for _, tt := range tests {
+		if got := tail(tt.s, tt.n); got != tt.want {
+			t.Errorf("tail(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	cfg := &config.Email{From: "Backup <backup@example.com>", To: []string{"ops@example.com", "dev@example.com"}}
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+
+	var errorOutput []string
+	for i := 1; i <= errorTailLines+5; i++ {
+		errorOutput = append(errorOutput, "pg_dump: line "+strings.Repeat("x", i))
+	}
+	failed := Report{
+		App:        "shop",
+		Set:        "nightly",
+		StartTime:  start,
+		EndTime:    start.Add(90 * time.Second),
+		TotalBytes: 3 << 20,
+		Items: []Item{
+			{Type: "directory", Name: "/srv/uploads", Success: true, Bytes: 2048},
+			{Type: "database", Name: "main", Error: strings.Join(errorOutput, "\n")},
+		},
+	}
+	succeeded := Report{App: "shop", Success: true, StartTime: start, EndTime: start.Add(time.Minute)}
+
+	tests := []struct {
+		name    string
+		report  Report
+		want    []string
+		notWant []string
+	}{
+		{"failed", failed, []string{
+			"From: Backup <backup@example.com>\r\n",
+			"To: ops@example.com, dev@example.com\r\n",
+			"Subject: Backup of shop (nightly) FAILED\r\n",
+			"Content-Type: text/plain; charset=utf-8\r\n\r\n",
+			"Backup of shop (nightly) failed in 1m30s, 3.0 MiB uploaded.\n",
+			"Started 2026-03-01T02:00:00Z, finished 2026-03-01T02:01:30Z.\n",
+			"OK      directory /srv/uploads (2.0 KiB)\n",
+			"FAILED  database main\n",
+			"Error output of database main:\n...\n",
+			errorOutput[len(errorOutput)-1],
+		}, []string{
+			// Only the last lines of the error output are included
+			errorOutput[4] + "\n",
+		}},
+		{"succeeded", succeeded, []string{
+			"Subject: Backup of shop succeeded\r\n",
+			"Backup of shop succeeded in 1m0s, 0 B uploaded.\n",
+		}, []string{"Error output", "The run failed"}},
+		{"run error", Report{App: "shop", StartTime: start, EndTime: start, Error: "storage unreachable"}, []string{
+			"Subject: Backup of shop FAILED\r\n",
+			"The run failed: storage unreachable\n",
+		}, nil},
+		{"non-ASCII name", Report{App: "Bäckerei", Success: true, StartTime: start, EndTime: start}, []string{
+			"Subject: =?utf-8?q?Backup_of_B=C3=A4ckerei_succeeded?=\r\n",
+		}, nil},
+	}
+	for _, tt := range tests {
+		msg := string(emailMessage(cfg, tt.report))
+		for _, want := range tt.want {
+			if !strings.Contains(msg, want) {
+				t.Errorf("%s: emailMessage() = %q, want it to contain %q", tt.name, msg, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(msg, notWant) {
+				t.Errorf("%s: emailMessage() = %q, want it not to contain %q", tt.name, msg, notWant)
+			}
+		}
+	}
+}
+
+func TestEnvelopeAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"backup@example.com", "backup@example.com"},
+		{"Backup <backup@example.com>", "backup@example.com"},
+		{`"Backup, Ops" <ops@example.com>`, "ops@example.com"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		if got := envelopeAddress(tt.addr); got != tt.want {
+			t.Errorf("envelopeAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
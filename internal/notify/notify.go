@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	retryDelay     = 5 * time.Second
+)
+
+// Report is the JSON payload sent at the end of a backup run
+type Report struct {
+	App string `json:"app"`
+	// Set is the backup set that ran, empty when all sets ran
+	Set       string    `json:"set,omitempty"`
+	Success   bool      `json:"success"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	// TotalBytes is the number of bytes uploaded by the run
+	TotalBytes int64  `json:"totalBytes"`
+	Items      []Item `json:"items"`
+	// Error is set when the run failed before backing up its items
+	Error string `json:"error,omitempty"`
+	// Runs is the number of runs combined in a digest, zero for a single run
+	Runs int `json:"runs,omitempty"`
+}
+
+// Item is the outcome of backing up one directory or database, or of the
+// post-backup hooks (type "hook") when they failed
+type Item struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	// Files and SnapshotID describe the created snapshot
+	Files      int64  `json:"files"`
+	SnapshotID string `json:"snapshotID,omitempty"`
+}
+
+// notifier delivers a report to one destination
+type notifier struct {
+	name string
+	url  string
+	// send delivers the encoded report, a POST to url when unset
+	send func(ctx context.Context, body []byte) error
+	// payload encodes the report for the destination
+	payload func(Report) ([]byte, error)
+	// throttle reports whether the report should be held back
+	throttle func(Report) bool
+	// sent is called after the report was delivered
+	sent func(Report)
+}
+
+// Send delivers the report to every configured destination. A failing
+// destination doesn't keep the report from the others. With a digest
+// interval, successful runs are collected and sent together once it passed.
+func Send(ctx context.Context, cfg *config.Notifications, report Report) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Digest > 0 && report.Success {
+		if err := addToDigest(report); err != nil {
+			return err
+		}
+		// The success ends the failure alerts of its set right away
+		if cfg.Slack != nil && cfg.Slack.Webhook != "" {
+			recordAlert(report)
+		}
+		return FlushDigest(ctx, cfg)
+	}
+	return sendReport(ctx, cfg, report)
+}
+
+// sendReport delivers a single report or a digest
+func sendReport(ctx context.Context, cfg *config.Notifications, report Report) error {
+	var notifiers []notifier
+	if cfg.Webhook != "" {
+		notifiers = append(notifiers, webhookNotifier(cfg.Webhook))
+	}
+	if cfg.Slack != nil && cfg.Slack.Webhook != "" {
+		notifiers = append(notifiers, slackNotifier(cfg.Slack))
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	// Emails go out for failed runs, for successful ones only on request
+	if cfg.Email != nil && cfg.Email.Host != "" && (!report.Success || cfg.Email.OnSuccess) {
+		notifiers = append(notifiers, emailNotifier(cfg.Email, timeout))
+	}
+
+	var errs []error
+	for _, n := range notifiers {
+		if n.throttle != nil && n.throttle(report) {
+			utils.Infof("Skipping %s notification, the same failure was reported recently", n.name)
+			continue
+		}
+		body, err := n.payload(report)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("encoding %s report: %w", n.name, err))
+			continue
+		}
+		send := n.send
+		if send == nil {
+			send = func(ctx context.Context, body []byte) error {
+				return post(ctx, client, n.url, body)
+			}
+		}
+		if err := deliver(ctx, n.name, send, body); err != nil {
+			errs = append(errs, fmt.Errorf("sending %s notification: %w", n.name, err))
+			continue
+		}
+		// The runs of a digest were recorded when they were collected
+		if n.sent != nil && report.Runs == 0 {
+			n.sent(report)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver sends body, retrying once
+func deliver(ctx context.Context, name string, send func(ctx context.Context, body []byte) error, body []byte) error {
+	err := send(ctx, body)
+	if err == nil {
+		return nil
+	}
+	utils.Warnf("Warning: %s delivery failed, retrying: %v", name, err)
+
+	select {
+	case <-time.After(retryDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return send(ctx, body)
+}
+
+func post(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+)
+
+const (
+	defaultRepeatInterval = 6 * time.Hour
+	// throttleFile remembers the last failure alert of every set
+	throttleFile = ".avolut/slack-alerts.json"
+)
+
+// slackNotifier posts a formatted summary to a Slack incoming webhook
+func slackNotifier(cfg *config.Slack) notifier {
+	interval := cfg.RepeatInterval
+	if interval <= 0 {
+		interval = defaultRepeatInterval
+	}
+
+	return notifier{
+		name: "slack",
+		url:  cfg.Webhook,
+		payload: func(report Report) ([]byte, error) {
+			return json.Marshal(struct {
+				Channel string `json:"channel,omitempty"`
+				Text    string `json:"text"`
+			}{cfg.Channel, slackMessage(report)})
+		},
+		throttle: func(report Report) bool {
+			return throttled(report, interval)
+		},
+		sent: recordAlert,
+	}
+}
+
+// slackMessage formats the report as Slack mrkdwn
+func slackMessage(report Report) string {
+	var b strings.Builder
+
+	status, result := ":white_check_mark:", "succeeded"
+	if !report.Success {
+		status, result = ":x:", "failed"
+	}
+	name := report.App
+	if report.Set != "" {
+		name += " (" + report.Set + ")"
+	}
+	if report.Runs > 0 {
+		fmt.Fprintf(&b, "%s *%d backups of %s succeeded* since %s, %s uploaded\n", status, report.Runs, name,
+			report.StartTime.Format(time.RFC3339), formatBytes(report.TotalBytes))
+	} else {
+		fmt.Fprintf(&b, "%s *Backup of %s %s* in %s, %s uploaded\n", status, name, result,
+			report.EndTime.Sub(report.StartTime).Round(time.Second), formatBytes(report.TotalBytes))
+	}
+
+	if report.Error != "" {
+		fmt.Fprintf(&b, "> %s\n", report.Error)
+	}
+	for _, item := range report.Items {
+		mark := ":white_check_mark:"
+		if !item.Success {
+			mark = ":x:"
+		}
+		fmt.Fprintf(&b, "%s %s `%s`", mark, item.Type, item.Name)
+		if item.Error != "" {
+			fmt.Fprintf(&b, ": %s", item.Error)
+		} else {
+			fmt.Fprintf(&b, " (%s)", formatBytes(item.Bytes))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// lastAlert is the last failure alert sent for a set
+type lastAlert struct {
+	Failures string    `json:"failures"`
+	Time     time.Time `json:"time"`
+}
+
+// failureKey identifies what failed in a run, so a repeat of the same
+// failures can be told apart from a new problem
+func failureKey(report Report) string {
+	var failed []string
+	if report.Error != "" {
+		failed = append(failed, "run")
+	}
+	for _, item := range report.Items {
+		if !item.Success {
+			failed = append(failed, item.Type+":"+item.Name)
+		}
+	}
+	sort.Strings(failed)
+	return strings.Join(failed, ",")
+}
+
+// throttled reports whether the same failures of the set were already
+// alerted within interval. Successful runs are never held back.
+func throttled(report Report, interval time.Duration) bool {
+	if report.Success {
+		return false
+	}
+	alert, ok := loadAlerts()[report.Set]
+	return ok && alert.Failures == failureKey(report) && time.Since(alert.Time) < interval
+}
+
+// recordAlert remembers a delivered failure alert, or forgets the last one
+// once the set succeeds again
+func recordAlert(report Report) {
+	alerts := loadAlerts()
+	if report.Success {
+		delete(alerts, report.Set)
+	} else {
+		alerts[report.Set] = lastAlert{Failures: failureKey(report), Time: time.Now()}
+	}
+
+	data, err := json.Marshal(alerts)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(throttleFile), 0755); err == nil {
+			err = os.WriteFile(throttleFile, data, 0644)
+		}
+	}
+	if err != nil {
+		utils.Warnf("Warning: error saving slack alert state: %v", err)
+	}
+}
+
+func loadAlerts() map[string]lastAlert {
+	alerts := map[string]lastAlert{}
+	data, err := os.ReadFile(throttleFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			utils.Warnf("Warning: error reading slack alert state: %v", err)
+		}
+		return alerts
+	}
+	if err := json.Unmarshal(data, &alerts); err != nil {
+		utils.Warnf("Warning: error reading slack alert state: %v", err)
+	}
+	return alerts
+}
@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the test in an empty working directory, where the alert
+// state is kept
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestFailureKey(t *testing.T) {
+	ok := Item{Type: "directory", Name: "/srv/a", Success: true}
+	dir := Item{Type: "directory", Name: "/srv/b"}
+	db := Item{Type: "database", Name: "main"}
+	tests := []struct {
+		report Report
+		want   string
+	}{
+		{Report{Success: true, Items: []Item{ok}}, ""},
+		{Report{Items: []Item{ok, dir}}, "directory:/srv/b"},
+		{Report{Items: []Item{dir, db}}, "database:main,directory:/srv/b"},
+		{Report{Items: []Item{db, ok, dir}}, "database:main,directory:/srv/b"},
+		{Report{Error: "storage unreachable"}, "run"},
+		{Report{Error: "hook failed", Items: []Item{db}}, "database:main,run"},
+	}
+	for _, tt := range tests {
+		if got := failureKey(tt.report); got != tt.want {
+			t.Errorf("failureKey(%+v) = %q, want %q", tt.report, got, tt.want)
+		}
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	inTempDir(t)
+
+	dir := Item{Type: "directory", Name: "/srv/b"}
+	db := Item{Type: "database", Name: "main"}
+	failed := Report{Set: "nightly", Items: []Item{dir}}
+	interval := time.Hour
+
+	if throttled(failed, interval) {
+		t.Fatal("throttled() = true before any alert was sent")
+	}
+	recordAlert(failed)
+
+	tests := []struct {
+		name     string
+		report   Report
+		interval time.Duration
+		want     bool
+	}{
+		{"same failure", failed, interval, true},
+		{"same failure after the interval", failed, 0, false},
+		{"other failure", Report{Set: "nightly", Items: []Item{dir, db}}, interval, false},
+		{"other set", Report{Set: "weekly", Items: []Item{dir}}, interval, false},
+		{"success", Report{Set: "nightly", Success: true}, interval, false},
+	}
+	for _, tt := range tests {
+		if got := throttled(tt.report, tt.interval); got != tt.want {
+			t.Errorf("%s: throttled() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A success clears the alert, so the next failure is sent right away
+	recordAlert(Report{Set: "nightly", Success: true})
+	if throttled(failed, interval) {
+		t.Error("throttled() = true after the set succeeded again")
+	}
+}
@@ -0,0 +1,14 @@
+package notify
+
+import "encoding/json"
+
+// webhookNotifier posts the report as JSON to a generic webhook
+func webhookNotifier(url string) notifier {
+	return notifier{
+		name: "webhook",
+		url:  url,
+		payload: func(report Report) ([]byte, error) {
+			return json.Marshal(report)
+		},
+	}
+}
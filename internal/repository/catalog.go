@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/content"
+	"github.com/kopia/kopia/snapshot"
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// AppStatus summarizes the backups of one app stored in the bucket
+type AppStatus struct {
+	Name string
+	// Sources is the number of backed up directories and databases
+	Sources int
+	// LastBackup is the end time of the most recent snapshot, zero if none
+	LastBackup time.Time
+}
+
+// ListApps returns the names of all apps that store backups in the bucket,
+// i.e. its top-level prefixes. This needs a key that can list the bucket and
+// is only supported for B2 storage.
+func ListApps(cfg *config.Config) ([]string, error) {
+	if cfg.Storage.Type != "" && cfg.Storage.Type != "b2" {
+		return nil, fmt.Errorf("listing apps is only supported for b2 storage")
+	}
+
+	b2, err := backblaze.NewB2(backblaze.Credentials{KeyID: B2KeyID, ApplicationKey: B2Key})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to B2: %w", err)
+	}
+	bucket, err := b2.Bucket(B2BucketName)
+	if err != nil {
+		return nil, fmt.Errorf("opening bucket %s: %w", B2BucketName, err)
+	}
+	if bucket == nil {
+		return nil, fmt.Errorf("bucket %s not found", B2BucketName)
+	}
+
+	var apps []string
+	start := ""
+	for {
+		resp, err := bucket.ListFileNamesWithPrefix(start, 1000, "", "/")
+		if err != nil {
+			return nil, fmt.Errorf("listing bucket: %w", err)
+		}
+		for _, f := range resp.Files {
+			if strings.HasSuffix(f.Name, "/") {
+				apps = append(apps, strings.TrimSuffix(f.Name, "/"))
+			}
+		}
+		if resp.NextFileName == "" {
+			return apps, nil
+		}
+		start = resp.NextFileName
+	}
+}
+
+// AppBackupStatus opens the repositories of another app read-only and
+// reports its most recent backup
+func AppBackupStatus(ctx context.Context, cfg *config.Config, app string) (AppStatus, error) {
+	status := AppStatus{Name: app}
+	appCfg := &config.Config{Name: app, Storage: cfg.Storage}
+
+	for _, suffix := range []string{"files", "dbs"} {
+		err := withReadOnlyRepository(ctx, appCfg, suffix, func(r repo.Repository) error {
+			sources, err := snapshot.ListSources(ctx, r)
+			if err != nil {
+				return fmt.Errorf("listing sources: %w", err)
+			}
+			status.Sources += len(sources)
+
+			for _, src := range sources {
+				snapshots, err := snapshot.ListSnapshots(ctx, r, src)
+				if err != nil {
+					return fmt.Errorf("listing snapshots of %v: %w", src, err)
+				}
+				for _, m := range snapshots {
+					if end := m.EndTime.ToTime(); end.After(status.LastBackup) {
+						status.LastBackup = end
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return status, fmt.Errorf("reading %s repository of %s: %w", suffix, app, err)
+		}
+	}
+
+	return status, nil
+}
+
+// withReadOnlyRepository connects to an existing repository using a
+// throwaway configuration and cache, so the app's own connection is not
+// touched. A missing repository is not an error.
+func withReadOnlyRepository(ctx context.Context, cfg *config.Config, suffix string, fn func(r repo.Repository) error) error {
+	password, err := cfg.RepositoryPassword()
+	if err != nil {
+		return err
+	}
+
+	st, err := newStorage(ctx, cfg, suffix)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "avolut-catalog-")
+	if err != nil {
+		return fmt.Errorf("creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	configPath := filepath.Join(tmpDir, "repository.config")
+	if err := repo.Connect(ctx, configPath, st, password, &repo.ConnectOptions{
+		CachingOptions: content.CachingOptions{
+			CacheDirectory: filepath.Join(tmpDir, "cache"),
+		},
+		ClientOptions: repo.ClientOptions{ReadOnly: true},
+	}); err != nil {
+		if errors.Is(err, repo.ErrRepositoryNotInitialized) {
+			return nil
+		}
+		return fmt.Errorf("connecting to repository: %w", err)
+	}
+
+	r, err := repo.Open(ctx, configPath, password, &repo.Options{})
+	if err != nil {
+		return fmt.Errorf("opening repository: %w", err)
+	}
+	defer r.Close(ctx)
+
+	return fn(r)
+}
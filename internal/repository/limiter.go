@@ -0,0 +1,294 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// limitedStorageType is the storage type written to repository.config for
+// storage wrapped by the request limiter, so kopia recreates the wrapper when
+// it opens the repository
+const limitedStorageType = "avolut-limited"
+
+const (
+	rateLimitMinBackoff = time.Second
+	rateLimitMaxBackoff = time.Minute
+	rateLimitMaxRetries = 10
+)
+
+type limitedOptions struct {
+	Inner blob.ConnectionInfo `json:"inner"`
+	// MaxRequests limits concurrent B2 requests across all repositories, zero is unlimited
+	MaxRequests int `json:"maxRequests,omitempty"`
+	// MaxUploadMBps limits the upload rate across all repositories, zero is unlimited
+	MaxUploadMBps float64 `json:"maxUploadMBps,omitempty"`
+	// MaxAttempts and BaseDelay control retries of transient failures
+	MaxAttempts int           `json:"maxAttempts,omitempty"`
+	BaseDelay   time.Duration `json:"baseDelay,omitempty"`
+}
+
+// limitedOptionsFor returns the limits and retry settings configured in cfg
+func limitedOptionsFor(cfg *config.Config) limitedOptions {
+	opt := limitedOptions{
+		MaxRequests:   cfg.Storage.MaxConcurrentRequests,
+		MaxUploadMBps: cfg.Storage.MaxUploadMBps,
+	}
+	if cfg.Retry != nil {
+		opt.MaxAttempts = cfg.Retry.MaxAttempts
+		opt.BaseDelay = cfg.Retry.BaseDelay
+	}
+	return opt
+}
+
+func init() {
+	blob.AddSupportedStorage(limitedStorageType, limitedOptions{}, func(ctx context.Context, opt *limitedOptions, isCreate bool) (blob.Storage, error) {
+		inner, err := blob.NewStorage(ctx, opt.Inner, isCreate)
+		if err != nil {
+			return nil, err
+		}
+		return newLimitedStorage(inner, *opt), nil
+	})
+}
+
+// requestLimiter is shared by every limited storage in the process so the
+// limit applies to all sources and repositories together
+type requestLimiter struct {
+	once  sync.Once
+	slots chan struct{}
+
+	mu         sync.Mutex
+	pauseUntil time.Time
+
+	uploads *tokenBucket
+	retry   retryPolicy
+}
+
+var limiter requestLimiter
+
+// init sizes the limiter. The first storage created decides the limits, since
+// all of them come from the same configuration.
+func (l *requestLimiter) init(opt limitedOptions) {
+	l.once.Do(func() {
+		if opt.MaxRequests > 0 {
+			l.slots = make(chan struct{}, opt.MaxRequests)
+		}
+		if opt.MaxUploadMBps > 0 {
+			l.uploads = newTokenBucket(opt.MaxUploadMBps * 1e6)
+		}
+		l.retry = newRetryPolicy(opt.MaxAttempts, opt.BaseDelay)
+	})
+}
+
+// pause holds back all new requests for the given duration
+func (l *requestLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pauseUntil) {
+		l.pauseUntil = until
+	}
+}
+
+func (l *requestLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	wait := time.Until(l.pauseUntil)
+	l.mu.Unlock()
+	if wait > 0 {
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *requestLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// tokenBucket limits a byte rate. Requests larger than the bucket are let
+// through and paid back by the following ones, so blobs of any size pass.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond float64) *tokenBucket {
+	return &tokenBucket{rate: bytesPerSecond, tokens: bytesPerSecond, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, waiting until the rate allows them
+func (b *tokenBucket) wait(ctx context.Context, n int64) error {
+	b.mu.Lock()
+	now := time.Now()
+	// Refill for the elapsed time, holding at most one second worth of bytes
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	return sleep(ctx, wait)
+}
+
+// limitedStorage runs every request through the shared limiter, throttles
+// uploads, backs off when B2 answers with 429 Too Many Requests and retries
+// transient failures
+type limitedStorage struct {
+	blob.Storage
+	opt limitedOptions
+}
+
+func newLimitedStorage(inner blob.Storage, opt limitedOptions) blob.Storage {
+	limiter.init(opt)
+	opt.Inner = blob.ConnectionInfo{}
+	return &limitedStorage{Storage: inner, opt: opt}
+}
+
+func (s *limitedStorage) do(ctx context.Context, fn func() error) error {
+	backoff := rateLimitMinBackoff
+	rateLimited, failed := 0, 0
+	for {
+		if err := limiter.acquire(ctx); err != nil {
+			return err
+		}
+		err := fn()
+		limiter.release()
+
+		switch {
+		case isRateLimited(err) && rateLimited < rateLimitMaxRetries:
+			// Neither B2 client exposes Retry-After, back off exponentially
+			rateLimited++
+			limiter.pause(backoff)
+			utils.Infof("Rate limited by B2, backing off (attempt %d/%d)", rateLimited, rateLimitMaxRetries)
+			backoff = min(backoff*2, rateLimitMaxBackoff)
+		case isTransient(ctx, err) && failed+1 < limiter.retry.maxAttempts:
+			failed++
+			delay := limiter.retry.delay(failed)
+			utils.Warnf("Warning: transient storage error, retrying in %v (attempt %d/%d): %v", delay.Round(time.Millisecond), failed, limiter.retry.maxAttempts-1, err)
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+func (s *limitedStorage) GetBlob(ctx context.Context, id blob.ID, offset, length int64, output blob.OutputBuffer) error {
+	return s.do(ctx, func() error {
+		output.Reset()
+		return s.Storage.GetBlob(ctx, id, offset, length, output)
+	})
+}
+
+func (s *limitedStorage) GetMetadata(ctx context.Context, id blob.ID) (blob.Metadata, error) {
+	var bm blob.Metadata
+	err := s.do(ctx, func() error {
+		var err error
+		bm, err = s.Storage.GetMetadata(ctx, id)
+		return err
+	})
+	return bm, err
+}
+
+func (s *limitedStorage) PutBlob(ctx context.Context, id blob.ID, data blob.Bytes, opts blob.PutOptions) error {
+	// Wait for upload bandwidth before taking a request slot
+	if limiter.uploads != nil {
+		if err := limiter.uploads.wait(ctx, int64(data.Length())); err != nil {
+			return err
+		}
+	}
+	return s.do(ctx, func() error {
+		return s.Storage.PutBlob(ctx, id, data, opts)
+	})
+}
+
+func (s *limitedStorage) DeleteBlob(ctx context.Context, id blob.ID) error {
+	return s.do(ctx, func() error {
+		return s.Storage.DeleteBlob(ctx, id)
+	})
+}
+
+func (s *limitedStorage) ListBlobs(ctx context.Context, prefix blob.ID, callback func(blob.Metadata) error) error {
+	// Collect the listing before calling back, so the slot is free for
+	// storage requests made by the callback and a failed listing can be
+	// retried without repeating results
+	var blobs []blob.Metadata
+	if err := s.do(ctx, func() error {
+		blobs = blobs[:0]
+		return s.Storage.ListBlobs(ctx, prefix, func(bm blob.Metadata) error {
+			blobs = append(blobs, bm)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, bm := range blobs {
+		if err := callback(bm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *limitedStorage) ConnectionInfo() blob.ConnectionInfo {
+	opt := s.opt
+	opt.Inner = s.Storage.ConnectionInfo()
+	return blob.ConnectionInfo{Type: limitedStorageType, Config: &opt}
+}
+
+// isRateLimited reports whether err is a 429 from the native B2 API or the
+// S3-compatible endpoint
+func isRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var b2err *backblaze.B2Error
+	if errors.As(err, &b2err) {
+		return b2err.Status == http.StatusTooManyRequests
+	}
+
+	var s3err minio.ErrorResponse
+	if errors.As(err, &s3err) {
+		return s3err.StatusCode == http.StatusTooManyRequests || s3err.Code == "SlowDown"
+	}
+
+	return false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
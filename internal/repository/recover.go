@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/kopia/kopia/repo/content"
+)
+
+// RecoveredSession describes a write session that was left behind by a
+// process that stopped before flushing it
+type RecoveredSession struct {
+	ID        content.SessionID
+	Host      string
+	StartTime time.Time
+	// Packs is the number of uploaded pack blobs that were not yet indexed
+	Packs int
+	// Contents is the number of contents recovered from those packs
+	Contents int
+}
+
+// RecoverSessions finds write sessions that were never committed, e.g.
+// because the daemon crashed in the middle of a flush. Contents in pack blobs
+// uploaded by such a session are added back to the index and the session
+// marker is removed. It must only run while no other process writes to the
+// repository.
+func RecoverSessions(ctx context.Context, r repo.Repository) ([]RecoveredSession, error) {
+	dr, ok := r.(repo.DirectRepository)
+	if !ok {
+		return nil, fmt.Errorf("repository does not support session recovery")
+	}
+
+	var recovered []RecoveredSession
+	err := repo.DirectWriteSession(ctx, dr, repo.WriteSessionOptions{
+		Purpose: "Recover sessions",
+	}, func(ctx context.Context, w repo.DirectRepositoryWriter) error {
+		sessions, err := w.ContentManager().ListActiveSessions(ctx)
+		if err != nil {
+			return fmt.Errorf("listing active sessions: %w", err)
+		}
+		if len(sessions) == 0 {
+			return nil
+		}
+
+		// Group pack blobs by the session that uploaded them
+		packs := map[content.SessionID][]blob.Metadata{}
+		for _, prefix := range content.PackBlobIDPrefixes {
+			if err := w.BlobReader().ListBlobs(ctx, prefix, func(bm blob.Metadata) error {
+				if sid := content.SessionIDFromBlobID(bm.BlobID); sessions[sid] != nil {
+					packs[sid] = append(packs[sid], bm)
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("listing pack blobs: %w", err)
+			}
+		}
+
+		for sid, info := range sessions {
+			rs := RecoveredSession{ID: sid, Host: info.Host, StartTime: info.StartTime}
+
+			// Re-index the contents of packs the session already uploaded
+			for _, bm := range packs[sid] {
+				infos, err := w.ContentManager().RecoverIndexFromPackBlob(ctx, bm.BlobID, bm.Length, true)
+				if err != nil {
+					return fmt.Errorf("recovering index from %s: %w", bm.BlobID, err)
+				}
+				rs.Packs++
+				rs.Contents += len(infos)
+			}
+
+			// Remove the session marker so the session is no longer active
+			if err := w.BlobReader().ListBlobs(ctx, content.BlobIDPrefixSession, func(bm blob.Metadata) error {
+				if content.SessionIDFromBlobID(bm.BlobID) != sid {
+					return nil
+				}
+				return w.BlobStorage().DeleteBlob(ctx, bm.BlobID)
+			}); err != nil {
+				return fmt.Errorf("removing marker of session %s: %w", sid, err)
+			}
+
+			recovered = append(recovered, rs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return recovered, nil
+}
+
+// RebuildIndexes re-reads the index stored at the end of every pack blob and
+// adds its contents back to the repository index. This repairs "content not
+// found" errors caused by lost or incomplete index blobs. It returns the
+// number of packs and contents processed.
+func RebuildIndexes(ctx context.Context, r repo.Repository) (packs int, contents int, err error) {
+	dr, ok := r.(repo.DirectRepository)
+	if !ok {
+		return 0, 0, fmt.Errorf("repository does not support index recovery")
+	}
+
+	err = repo.DirectWriteSession(ctx, dr, repo.WriteSessionOptions{
+		Purpose: "Rebuild indexes",
+	}, func(ctx context.Context, w repo.DirectRepositoryWriter) error {
+		for _, prefix := range content.PackBlobIDPrefixes {
+			blobs, err := blob.ListAllBlobs(ctx, w.BlobReader(), prefix)
+			if err != nil {
+				return fmt.Errorf("listing pack blobs: %w", err)
+			}
+			for _, bm := range blobs {
+				infos, err := w.ContentManager().RecoverIndexFromPackBlob(ctx, bm.BlobID, bm.Length, true)
+				if err != nil {
+					return fmt.Errorf("recovering index from %s: %w", bm.BlobID, err)
+				}
+				packs++
+				contents += len(infos)
+			}
+		}
+		return nil
+	})
+	return packs, contents, err
+}
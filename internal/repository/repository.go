@@ -7,10 +7,16 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/avolut/backup/internal/config"
+	"github.com/avolut/backup/internal/utils"
 	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/blob"
 	"github.com/kopia/kopia/repo/blob/b2"
+	"github.com/kopia/kopia/repo/blob/filesystem"
+	"github.com/kopia/kopia/repo/blob/gcs"
+	"github.com/kopia/kopia/repo/blob/s3"
 	"github.com/kopia/kopia/repo/content"
 )
 
@@ -22,7 +28,6 @@ const (
 )
 
 const (
-	backupPassword = "avolut123"
 	// Exported B2 storage credentials
 	B2BucketName = "avolut-backup"
 	B2KeyID      = "004a2c1d76ae1cf0000000003"
@@ -55,6 +60,141 @@ func formatPrefix(name string, suffix string) string {
 	return prefix
 }
 
+// newStorage creates the blob storage for the given repository suffix,
+// retrying transient failures to reach it
+func newStorage(ctx context.Context, cfg *config.Config, suffix string) (blob.Storage, error) {
+	policy := newRetryPolicy(0, 0)
+	if cfg.Retry != nil {
+		policy = newRetryPolicy(cfg.Retry.MaxAttempts, cfg.Retry.BaseDelay)
+	}
+
+	for attempt := 1; ; attempt++ {
+		st, err := openStorage(ctx, cfg, suffix)
+		if err == nil || !isTransient(ctx, err) || attempt >= policy.maxAttempts {
+			return st, err
+		}
+		delay := policy.delay(attempt)
+		utils.Warnf("Warning: %v, retrying in %v (attempt %d/%d)", err, delay.Round(time.Millisecond), attempt, policy.maxAttempts-1)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// openStorage creates the blob storage for the given repository suffix. B2 is
+// reached through its native API unless a region or S3-compatible endpoint is
+// configured. All storage goes through the shared request limiter.
+func openStorage(ctx context.Context, cfg *config.Config, suffix string) (blob.Storage, error) {
+	prefix := formatPrefix(cfg.Name, suffix)
+
+	switch cfg.Storage.Type {
+	case "", "b2":
+	case "s3":
+		return newS3Storage(ctx, cfg, prefix)
+	case "gcs":
+		return newGCSStorage(ctx, cfg, prefix)
+	case "filesystem":
+		return newFilesystemStorage(ctx, cfg, prefix)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q, use b2, s3, gcs or filesystem", cfg.Storage.Type)
+	}
+
+	if cfg.Storage.Endpoint != "" || cfg.Storage.Region != "" {
+		endpoint := cfg.Storage.Endpoint
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("s3.%s.backblazeb2.com", cfg.Storage.Region)
+		}
+
+		st, err := s3.New(ctx, &s3.Options{
+			BucketName:      B2BucketName,
+			Prefix:          prefix,
+			Endpoint:        endpoint,
+			Region:          cfg.Storage.Region,
+			AccessKeyID:     B2KeyID,
+			SecretAccessKey: B2Key,
+		}, true)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to B2 endpoint %s: %w", endpoint, err)
+		}
+		return newLimitedStorage(st, limitedOptionsFor(cfg)), nil
+	}
+
+	// Use B2 configuration with TLS settings
+	st, err := b2.New(ctx, &b2.Options{
+		BucketName: B2BucketName,
+		KeyID:      B2KeyID,
+		Key:        B2Key,
+		Prefix:     prefix,
+	}, true)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to B2: %w", err)
+	}
+	return newLimitedStorage(st, limitedOptionsFor(cfg)), nil
+}
+
+// newS3Storage creates storage in a bucket of any S3-compatible service
+func newS3Storage(ctx context.Context, cfg *config.Config, prefix string) (blob.Storage, error) {
+	if cfg.Storage.Endpoint == "" || cfg.Storage.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage requires endpoint and bucket")
+	}
+
+	st, err := s3.New(ctx, &s3.Options{
+		BucketName:      cfg.Storage.Bucket,
+		Prefix:          prefix,
+		Endpoint:        cfg.Storage.Endpoint,
+		DoNotUseTLS:     cfg.Storage.DisableTLS,
+		Region:          cfg.Storage.Region,
+		AccessKeyID:     cfg.Storage.AccessKeyID,
+		SecretAccessKey: cfg.Storage.SecretAccessKey,
+	}, true)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to S3 endpoint %s: %w", cfg.Storage.Endpoint, err)
+	}
+	return newLimitedStorage(st, limitedOptionsFor(cfg)), nil
+}
+
+// newGCSStorage creates storage in a Google Cloud Storage bucket, below the
+// configured prefix
+func newGCSStorage(ctx context.Context, cfg *config.Config, prefix string) (blob.Storage, error) {
+	if cfg.Storage.Bucket == "" {
+		return nil, fmt.Errorf("gcs storage requires bucket")
+	}
+
+	if cfg.Storage.Prefix != "" {
+		prefix = strings.TrimSuffix(cfg.Storage.Prefix, "/") + "/" + prefix
+	}
+	st, err := gcs.New(ctx, &gcs.Options{
+		BucketName:                    cfg.Storage.Bucket,
+		Prefix:                        prefix,
+		ServiceAccountCredentialsFile: cfg.Storage.CredentialsFile,
+	}, true)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to GCS bucket %s: %w", cfg.Storage.Bucket, err)
+	}
+	return newLimitedStorage(st, limitedOptionsFor(cfg)), nil
+}
+
+// newFilesystemStorage creates storage in a local directory or mount, with
+// the repositories in subdirectories named like the prefixes in a bucket
+func newFilesystemStorage(ctx context.Context, cfg *config.Config, prefix string) (blob.Storage, error) {
+	if cfg.Storage.Path == "" {
+		return nil, fmt.Errorf("filesystem storage requires path")
+	}
+
+	// repository.config is read from other working directories too
+	root, err := filepath.Abs(cfg.Storage.Path)
+	if err != nil {
+		return nil, fmt.Errorf("resolving storage path: %w", err)
+	}
+	st, err := filesystem.New(ctx, &filesystem.Options{
+		Path: filepath.Join(root, filepath.FromSlash(prefix)),
+	}, true)
+	if err != nil {
+		return nil, fmt.Errorf("opening storage directory %s: %w", cfg.Storage.Path, err)
+	}
+	return newLimitedStorage(st, limitedOptionsFor(cfg)), nil
+}
+
 func ConnectToRepository(ctx context.Context, cfg *config.Config, configType ConfigType, suffix string) (repo.Repository, error) {
 	// Create config file path
 	configPath := filepath.Join(".avolut", suffix, "repository.config")
@@ -64,23 +204,29 @@ func ConnectToRepository(ctx context.Context, cfg *config.Config, configType Con
 		return nil, fmt.Errorf("creating config directories: %w", err)
 	}
 
+	password, err := cfg.RepositoryPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := newStorage(ctx, cfg, suffix)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create config file with proper JSON structure
+	storageInfo := st.ConnectionInfo()
 	configData := map[string]interface{}{
 		"storage": map[string]interface{}{
-			"type": "b2",
-			"config": map[string]interface{}{
-				"bucket": B2BucketName,
-				"prefix": formatPrefix(cfg.Name, suffix),
-				"keyID":  B2KeyID,
-				"key":    B2Key,
-			},
+			"type":   storageInfo.Type,
+			"config": storageInfo.Config,
 		},
 		"caching": map[string]interface{}{
 			"cacheDirectory": "cache",
 		},
 		"hostname":                "avolut-backup",
 		"username":                os.Getenv("USER"),
-		"description":             fmt.Sprintf("Repository in B2: %s", B2BucketName),
+		"description":             fmt.Sprintf("Repository in %s", st.DisplayName()),
 		"enableActions":           false,
 		"formatBlobCacheDuration": 900000000000,
 	}
@@ -94,44 +240,79 @@ func ConnectToRepository(ctx context.Context, cfg *config.Config, configType Con
 		return nil, fmt.Errorf("writing config file: %w", err)
 	}
 
-	// Use B2 configuration with TLS settings
-	opts := &b2.Options{
-		BucketName: B2BucketName,
-		KeyID:      B2KeyID,
-		Key:        B2Key,
-		Prefix:     formatPrefix(cfg.Name, suffix),
-	}
-
-	st, err := b2.New(ctx, opts, true)
-	if err != nil {
-		return nil, fmt.Errorf("connecting to B2: %w", err)
-	}
-
 	// Initialize repository if needed
 	initOpts := &repo.NewRepositoryOptions{}
 
 	// Initialize repository if needed
-	if err := repo.Initialize(ctx, st, initOpts, backupPassword); err != nil {
+	if err := repo.Initialize(ctx, st, initOpts, password); err != nil {
 		if err != repo.ErrAlreadyInitialized {
 			return nil, fmt.Errorf("initializing repository: %w", err)
 		}
 	}
 
+	// Size the caches, content defaults to 1GB
+	contentCacheSize := cfg.Cache.ContentCacheSizeBytes
+	if contentCacheSize <= 0 {
+		contentCacheSize = 1024 * 1024 * 1024 // 1GB
+	}
+
 	// Connect to the repository
-	if err := repo.Connect(ctx, configPath, st, backupPassword, &repo.ConnectOptions{
+	if err := repo.Connect(ctx, configPath, st, password, &repo.ConnectOptions{
 		CachingOptions: content.CachingOptions{
-			CacheDirectory:        ".avolut/" + suffix + "/cache",
-			ContentCacheSizeBytes: 1024 * 1024 * 1024, // 1GB
+			CacheDirectory:         ".avolut/" + suffix + "/cache",
+			ContentCacheSizeBytes:  contentCacheSize,
+			MetadataCacheSizeBytes: cfg.Cache.MetadataCacheSizeBytes,
 		},
 	}); err != nil {
 		return nil, fmt.Errorf("connecting to repository: %w", err)
 	}
 
 	// Open repository
-	r, err := repo.Open(ctx, configPath, backupPassword, &repo.Options{})
+	r, err := repo.Open(ctx, configPath, password, &repo.Options{})
 	if err != nil {
 		return nil, fmt.Errorf("opening repository: %w", err)
 	}
 
 	return r, nil
 }
+
+// CheckStorage connects to the configured storage and lists the files
+// repository, to verify the bucket and credentials before the first backup
+func CheckStorage(ctx context.Context, cfg *config.Config) error {
+	st, err := newStorage(ctx, cfg, "files")
+	if err != nil {
+		return err
+	}
+	defer st.Close(ctx)
+
+	// Only the format blob, the repository may already hold many packs
+	if err := st.ListBlobs(ctx, "kopia.repository", func(blob.Metadata) error { return nil }); err != nil {
+		return fmt.Errorf("listing storage: %w", err)
+	}
+	return nil
+}
+
+// DeleteRepository removes every blob of the repository with the given suffix
+// from storage along with its local configuration and cache
+func DeleteRepository(ctx context.Context, cfg *config.Config, suffix string) error {
+	st, err := newStorage(ctx, cfg, suffix)
+	if err != nil {
+		return err
+	}
+	defer st.Close(ctx)
+
+	blobs, err := blob.ListAllBlobs(ctx, st, "")
+	if err != nil {
+		return fmt.Errorf("listing blobs: %w", err)
+	}
+	for _, bm := range blobs {
+		if err := st.DeleteBlob(ctx, bm.BlobID); err != nil {
+			return fmt.Errorf("deleting blob %s: %w", bm.BlobID, err)
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(".avolut", suffix)); err != nil {
+		return fmt.Errorf("removing local repository state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+const (
+	defaultRetryAttempts  = 5
+	defaultRetryBaseDelay = time.Second
+	retryMaxDelay         = 2 * time.Minute
+)
+
+// retryPolicy retries transient storage failures with exponential backoff
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+func newRetryPolicy(maxAttempts int, baseDelay time.Duration) retryPolicy {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryAttempts
+	}
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+	return retryPolicy{maxAttempts: maxAttempts, baseDelay: baseDelay}
+}
+
+// delay returns the wait before the given retry, doubling with every attempt
+// plus up to 50% jitter so parallel uploads don't retry in lockstep
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.baseDelay << min(attempt-1, 20)
+	d = min(d, retryMaxDelay)
+	return d + time.Duration(rand.Int64N(int64(d)/2+1))
+}
+
+// isTransient reports whether err is worth retrying: timeouts, dropped
+// connections and server errors. Authentication failures, missing blobs and
+// configuration mistakes are not, and neither is a cancelled run.
+func isTransient(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+
+	var b2err *backblaze.B2Error
+	if errors.As(err, &b2err) {
+		return b2err.Status >= http.StatusInternalServerError || b2err.Status == http.StatusRequestTimeout
+	}
+	var s3err minio.ErrorResponse
+	if errors.As(err, &s3err) {
+		return s3err.StatusCode >= http.StatusInternalServerError || s3err.StatusCode == http.StatusRequestTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	// Some clients flatten the cause into the message
+	msg := err.Error()
+	for _, s := range []string{"connection reset by peer", "i/o timeout", "TLS handshake timeout", "unexpected EOF"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
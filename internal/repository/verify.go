@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+// VerifyResult summarizes the verification of a repository
+type VerifyResult struct {
+	Snapshots int
+	Files     int
+	// Problems describes every file or directory that failed verification
+	Problems []string
+}
+
+// VerifyRepository walks all snapshots in the repository and checks that
+// every file resolves to existing contents stored in existing blobs. The
+// given percentage of files is also read completely to detect corrupted data.
+func VerifyRepository(ctx context.Context, r repo.Repository, percent float64) (VerifyResult, error) {
+	var result VerifyResult
+
+	// Check that contents are backed by blobs that still exist
+	var blobMap map[blob.ID]blob.Metadata
+	if dr, ok := r.(repo.DirectRepository); ok {
+		var err error
+		if blobMap, err = blob.ReadBlobMap(ctx, dr.BlobReader()); err != nil {
+			return result, fmt.Errorf("listing blobs: %w", err)
+		}
+	}
+	verifier := snapshotfs.NewVerifier(ctx, r, snapshotfs.VerifierOptions{
+		VerifyFilesPercent: percent,
+		BlobMap:            blobMap,
+	})
+
+	var mu sync.Mutex
+	walker, err := snapshotfs.NewTreeWalker(ctx, snapshotfs.TreeWalkerOptions{
+		EntryCallback: func(ctx context.Context, e fs.Entry, oid object.ID, entryPath string) error {
+			if e.IsDir() {
+				return nil
+			}
+			err := verifier.VerifyFile(ctx, oid, entryPath)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Files++
+			if err != nil {
+				result.Problems = append(result.Problems, fmt.Sprintf("%s: %v", entryPath, err))
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return result, fmt.Errorf("creating tree walker: %w", err)
+	}
+	defer walker.Close(ctx)
+
+	ids, err := snapshot.ListSnapshotManifests(ctx, r, nil, nil)
+	if err != nil {
+		return result, fmt.Errorf("listing snapshots: %w", err)
+	}
+	manifests, err := snapshot.LoadSnapshots(ctx, r, ids)
+	if err != nil {
+		return result, fmt.Errorf("loading snapshots: %w", err)
+	}
+
+	for _, m := range manifests {
+		if m.RootEntry == nil {
+			continue
+		}
+		rootPath := fmt.Sprintf("%s@%s", m.Source.Path, m.StartTime.ToTime().Format("2006-01-02T15:04:05"))
+		root, err := snapshotfs.SnapshotRoot(r, m)
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: %v", rootPath, err))
+			continue
+		}
+		result.Snapshots++
+
+		// Directories that can't be read are reported through the walker
+		walker.Process(ctx, root, rootPath)
+	}
+
+	if err := walker.Err(); err != nil {
+		result.Problems = append(result.Problems, err.Error())
+	}
+	return result, nil
+}
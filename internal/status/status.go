@@ -0,0 +1,187 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/avolut/backup/internal/notify"
+)
+
+// File holds the outcome of the last run of every backup set, for --status
+// and external monitoring
+const File = ".avolut/state.json"
+
+// AllSets is the key of runs that backed up every set at once
+const AllSets = "all"
+
+// Run is the outcome of one backup run
+type Run struct {
+	Success    bool      `json:"success"`
+	StartTime  time.Time `json:"startTime"`
+	EndTime    time.Time `json:"endTime"`
+	TotalBytes int64     `json:"totalBytes"`
+	Error      string    `json:"error,omitempty"`
+	// Failed is the number of items that failed
+	Failed int `json:"failed"`
+	// Items holds the status, bytes, files and snapshot of every source
+	Items []notify.Item `json:"items"`
+}
+
+// SetStatus is the last run of a backup set and the time of its last
+// successful run, which is kept when later runs fail
+type SetStatus struct {
+	LastRun     Run        `json:"lastRun"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// Load reads the status of every set, empty if nothing was recorded yet
+func Load() (map[string]SetStatus, error) {
+	sets := map[string]SetStatus{}
+	data, err := os.ReadFile(File)
+	if errors.Is(err, os.ErrNotExist) {
+		return sets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading status: %w", err)
+	}
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return nil, fmt.Errorf("parsing status: %w", err)
+	}
+	return sets, nil
+}
+
+// Record stores the outcome of a backup run. The file is replaced atomically
+// so a crash never leaves a partial file.
+func Record(report notify.Report) error {
+	sets, err := Load()
+	if err != nil {
+		return err
+	}
+
+	key := report.Set
+	if key == "" {
+		key = AllSets
+	}
+	set := sets[key]
+	set.LastRun = Run{
+		Success:    report.Success,
+		StartTime:  report.StartTime,
+		EndTime:    report.EndTime,
+		TotalBytes: report.TotalBytes,
+		Error:      report.Error,
+		Items:      report.Items,
+	}
+	for _, item := range report.Items {
+		if !item.Success {
+			set.LastRun.Failed++
+		}
+	}
+	if report.Success {
+		set.LastSuccess = &report.EndTime
+	}
+	sets[key] = set
+
+	data, err := json.MarshalIndent(sets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding status: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(File), 0755); err != nil {
+		return fmt.Errorf("creating status directory: %w", err)
+	}
+	tmp := File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing status: %w", err)
+	}
+	if err := os.Rename(tmp, File); err != nil {
+		return fmt.Errorf("replacing status file: %w", err)
+	}
+	return nil
+}
+
+// MaintenanceFile holds the time of the last repository maintenance, so the
+// daemon keeps its interval across restarts
+const MaintenanceFile = ".avolut/maintenance.txt"
+
+// RecordMaintenance stores the time of a finished repository maintenance
+func RecordMaintenance(t time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(MaintenanceFile), 0755); err != nil {
+		return fmt.Errorf("creating status directory: %w", err)
+	}
+	if err := os.WriteFile(MaintenanceFile, []byte(t.Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing maintenance time: %w", err)
+	}
+	return nil
+}
+
+// LastMaintenance returns the time of the last repository maintenance, the
+// zero time if none was recorded
+func LastMaintenance() (time.Time, error) {
+	data, err := os.ReadFile(MaintenanceFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading maintenance time: %w", err)
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing maintenance time: %w", err)
+	}
+	return t, nil
+}
+
+// ProgressFile holds the progress of the running backup, rewritten every
+// minute and removed when the run ends
+const ProgressFile = ".avolut/progress.txt"
+
+// progressMaxAge is how long a progress file counts as current, so a crashed
+// run doesn't show as running forever
+const progressMaxAge = 2 * time.Minute
+
+// RecordProgress stores the progress of the running backup
+func RecordProgress(progress string) error {
+	if err := os.MkdirAll(filepath.Dir(ProgressFile), 0755); err != nil {
+		return fmt.Errorf("creating status directory: %w", err)
+	}
+	tmp := ProgressFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(progress+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing progress: %w", err)
+	}
+	if err := os.Rename(tmp, ProgressFile); err != nil {
+		return fmt.Errorf("replacing progress file: %w", err)
+	}
+	return nil
+}
+
+// ClearProgress removes the progress once the run ended
+func ClearProgress() error {
+	if err := os.Remove(ProgressFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing progress file: %w", err)
+	}
+	return nil
+}
+
+// Progress returns the progress of the running backup, false if no backup is
+// running
+func Progress() (string, bool, error) {
+	info, err := os.Stat(ProgressFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("reading progress: %w", err)
+	}
+	if time.Since(info.ModTime()) > progressMaxAge {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(ProgressFile)
+	if err != nil {
+		return "", false, fmt.Errorf("reading progress: %w", err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
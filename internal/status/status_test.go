@@ -0,0 +1,81 @@
+package status
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/avolut/backup/internal/notify"
+)
+
+func TestRecord(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	run := func(set string, day int, success bool, items ...notify.Item) notify.Report {
+		begin := start.AddDate(0, 0, day)
+		return notify.Report{Set: set, Success: success, StartTime: begin, EndTime: begin.Add(time.Minute), TotalBytes: 100, Items: items}
+	}
+	backedUp := notify.Item{Type: "directory", Name: "/srv/a", Success: true}
+	failed := notify.Item{Type: "database", Name: "main", Error: "connection refused"}
+
+	tests := []struct {
+		name        string
+		report      notify.Report
+		key         string
+		wantFailed  int
+		wantSuccess *time.Time
+	}{
+		{"first success", run("nightly", 0, true, backedUp), "nightly", 0, ptr(start.Add(time.Minute))},
+		// A failure keeps the time of the last successful run
+		{"failure", run("nightly", 1, false, backedUp, failed, failed), "nightly", 2, ptr(start.Add(time.Minute))},
+		{"success again", run("nightly", 2, true, backedUp), "nightly", 0, ptr(start.AddDate(0, 0, 2).Add(time.Minute))},
+		{"all sets", run("", 3, false, failed), AllSets, 1, nil},
+	}
+	for _, tt := range tests {
+		if err := Record(tt.report); err != nil {
+			t.Fatalf("%s: Record() = %v", tt.name, err)
+		}
+		sets, err := Load()
+		if err != nil {
+			t.Fatalf("%s: Load() = %v", tt.name, err)
+		}
+		got, ok := sets[tt.key]
+		if !ok {
+			t.Errorf("%s: no status recorded for %s", tt.name, tt.key)
+			continue
+		}
+		if got.LastRun.Success != tt.report.Success || !got.LastRun.StartTime.Equal(tt.report.StartTime) || len(got.LastRun.Items) != len(tt.report.Items) {
+			t.Errorf("%s: last run = %+v, want the recorded report", tt.name, got.LastRun)
+		}
+		if got.LastRun.Failed != tt.wantFailed {
+			t.Errorf("%s: failed = %d, want %d", tt.name, got.LastRun.Failed, tt.wantFailed)
+		}
+		if (got.LastSuccess == nil) != (tt.wantSuccess == nil) || (got.LastSuccess != nil && !got.LastSuccess.Equal(*tt.wantSuccess)) {
+			t.Errorf("%s: last success = %v, want %v", tt.name, got.LastSuccess, tt.wantSuccess)
+		}
+	}
+
+	// Every set keeps its own status
+	sets, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Errorf("Load() = %d sets, want 2", len(sets))
+	}
+	if _, err := os.Stat(File + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary status file left behind: %v", err)
+	}
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const launchdLabel = "com.avolut.backup"
+
+const launchdTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>--daemon</string>
+	</array>
+	<key>WorkingDirectory</key>
+	<string>%s</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>5</integer>
+</dict>
+</plist>
+`
+
+// launchdPlistPath returns the path of the launch agent in the user's
+// LaunchAgents directory
+func launchdPlistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+}
+
+// InstallLaunchdService installs the backup daemon as a launchd agent on
+// macOS, restarted like the systemd service when it fails
+func InstallLaunchdService() error {
+	if _, err := exec.LookPath("launchctl"); err != nil {
+		return fmt.Errorf("launchd is not available on this system")
+	}
+
+	// Get the absolute path of the current executable
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute executable path: %w", err)
+	}
+
+	// Get the current working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	// Write the plist
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		return fmt.Errorf("failed to create LaunchAgents directory: %w", err)
+	}
+	plist := fmt.Sprintf(launchdTemplate, launchdLabel, xmlEscape(exePath), xmlEscape(wd))
+	if err := os.WriteFile(plistPath, []byte(plist), 0644); err != nil {
+		return fmt.Errorf("failed to write plist: %w", err)
+	}
+
+	// Load and start the agent, replacing an older version
+	_ = exec.Command("launchctl", "unload", plistPath).Run()
+	if output, err := exec.Command("launchctl", "load", "-w", plistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load launch agent: %w: %s", err, output)
+	}
+
+	return nil
+}
+
+// RemoveLaunchdService stops and removes the launchd agent
+func RemoveLaunchdService() error {
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+
+	// Stop and unload the agent
+	_ = exec.Command("launchctl", "unload", "-w", plistPath).Run() // Ignore errors as it might not be loaded
+
+	// Remove plist
+	if err := os.Remove(plistPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove plist: %w", err)
+	}
+
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
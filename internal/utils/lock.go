@@ -0,0 +1,11 @@
+//go:build !unix || aix
+
+package utils
+
+// tryFileLock is a stub for systems without flock, only the in-process lock applies
+func tryFileLock(path string) (bool, error) {
+	return true, nil
+}
+
+// releaseFileLock is a stub for systems without flock
+func releaseFileLock() {}
@@ -0,0 +1,53 @@
+//go:build unix && !aix
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+var lockFile *os.File
+
+// tryFileLock takes an advisory flock on path. The kernel drops the lock when
+// the holding process exits, so a crashed process never leaves it behind.
+func tryFileLock(path string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("creating lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, fmt.Errorf("opening lock file: %w", err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, fmt.Errorf("locking %s: %w", path, err)
+	}
+
+	// Record the holder to help debugging, the lock itself is the flock
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	lockFile = f
+	return true, nil
+}
+
+// releaseFileLock drops the flock. The file is kept, removing it could let
+// two processes lock different files of the same name.
+func releaseFileLock() {
+	if lockFile == nil {
+		return
+	}
+	unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+	lockFile.Close()
+	lockFile = nil
+}
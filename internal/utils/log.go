@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// debugLogging enables the detailed per-item log
+var debugLogging atomic.Bool
+
+// jsonLogging writes log entries as JSON lines instead of text
+var jsonLogging atomic.Bool
+
+// jsonMutex keeps JSON lines of concurrent writers from interleaving
+var jsonMutex sync.Mutex
+
+// SetLogLevel sets the log verbosity. "info" (the default) only logs
+// summaries and errors, "debug" also logs every backed up item.
+func SetLogLevel(level string) error {
+	switch level {
+	case "", "info":
+		debugLogging.Store(false)
+	case "debug":
+		debugLogging.Store(true)
+	default:
+		return fmt.Errorf("unknown log level %q, use info or debug", level)
+	}
+	return nil
+}
+
+// SetLogFormat sets the log output format. "text" (the default) writes the
+// usual log lines, "json" writes one JSON object per entry with the fields
+// time, level, message and any fields attached with With.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		jsonLogging.Store(false)
+	case "json":
+		jsonLogging.Store(true)
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+	return nil
+}
+
+// DebugEnabled reports whether the detailed log is enabled
+func DebugEnabled() bool {
+	return debugLogging.Load()
+}
+
+// Logger is a leveled logger with fields attached to every entry, e.g. the
+// source or snapshot an entry is about. Fields only show in the JSON format,
+// the text format logs the message alone.
+type Logger struct {
+	fields []any
+}
+
+// With returns a logger adding the given key value pairs to every entry
+func With(keyvals ...any) Logger {
+	return Logger{}.With(keyvals...)
+}
+
+// With returns a logger adding more key value pairs to every entry
+func (l Logger) With(keyvals ...any) Logger {
+	return Logger{fields: append(append([]any{}, l.fields...), keyvals...)}
+}
+
+// Debugf logs only when the debug log level is set
+func (l Logger) Debugf(format string, args ...any) {
+	if debugLogging.Load() {
+		l.output("debug", fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof logs an informational entry
+func (l Logger) Infof(format string, args ...any) {
+	l.output("info", fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a problem that doesn't stop the current operation
+func (l Logger) Warnf(format string, args ...any) {
+	l.output("warning", fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a failed operation
+func (l Logger) Errorf(format string, args ...any) {
+	l.output("error", fmt.Sprintf(format, args...))
+}
+
+func (l Logger) output(level, message string) {
+	if !jsonLogging.Load() {
+		log.Print(message)
+		return
+	}
+
+	// The level field replaces the prefixes of the text format
+	message = strings.TrimPrefix(message, "Warning: ")
+	entry := map[string]any{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level":   level,
+		"message": message,
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		entry[fmt.Sprint(l.fields[i])] = l.fields[i+1]
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Print(message)
+		return
+	}
+
+	jsonMutex.Lock()
+	defer jsonMutex.Unlock()
+	log.Writer().Write(append(line, '\n'))
+}
+
+// Debugf logs only when the debug log level is set
+func Debugf(format string, args ...any) {
+	Logger{}.Debugf(format, args...)
+}
+
+// Infof logs an informational entry without fields
+func Infof(format string, args ...any) {
+	Logger{}.Infof(format, args...)
+}
+
+// Warnf logs a warning without fields
+func Warnf(format string, args ...any) {
+	Logger{}.Warnf(format, args...)
+}
+
+// Errorf logs an error without fields
+func Errorf(format string, args ...any) {
+	Logger{}.Errorf(format, args...)
+}
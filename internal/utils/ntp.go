@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between 1900-01-01 and 1970-01-01
+const ntpEpochOffset = 2208988800
+
+// QueryClockOffset asks an NTP server for the current time and returns how far
+// the local clock is off. A positive offset means the local clock is behind.
+func QueryClockOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("connecting to NTP server %s: %w", server, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return 0, err
+	}
+
+	// SNTP client request: LI=0, VN=4, Mode=3
+	req := make([]byte, 48)
+	req[0] = 0x23
+
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, fmt.Errorf("sending NTP request: %w", err)
+	}
+
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, fmt.Errorf("reading NTP response: %w", err)
+	}
+	received := time.Now()
+
+	serverReceived := ntpTime(resp[32:40])
+	serverSent := ntpTime(resp[40:48])
+	if serverSent.IsZero() {
+		return 0, fmt.Errorf("invalid NTP response from %s", server)
+	}
+
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// ntpTime converts a 64-bit NTP timestamp into a time.Time
+func ntpTime(b []byte) time.Time {
+	seconds := binary.BigEndian.Uint32(b[0:4])
+	fraction := binary.BigEndian.Uint32(b[4:8])
+	if seconds == 0 && fraction == 0 {
+		return time.Time{}
+	}
+
+	nanos := (int64(fraction) * 1e9) >> 32
+	return time.Unix(int64(seconds)-ntpEpochOffset, nanos)
+}
@@ -64,6 +64,11 @@ func InstallSystemdService() error {
 		return fmt.Errorf("failed to get working directory: %w", err)
 	}
 
+	// Replace timers of an earlier installation
+	if err := removeSystemdTimers(); err != nil {
+		return err
+	}
+
 	// Create service unit file content
 	serviceContent := fmt.Sprintf(serviceTemplate, exePath, wd)
 
@@ -88,12 +93,17 @@ func InstallSystemdService() error {
 	return nil
 }
 
-// RemoveSystemdService removes the backup service
+// RemoveSystemdService removes the backup service, or the timers installed
+// instead of it
 func RemoveSystemdService() error {
 	if !IsSystemdAvailable() {
 		return fmt.Errorf("systemd is not available on this system")
 	}
 
+	if err := removeSystemdTimers(); err != nil {
+		return err
+	}
+
 	// Stop and disable the service
 	cmd := exec.Command("systemctl", "disable", "--now", "avolut-backup.service")
 	_ = cmd.Run() // Ignore errors as service might not be running
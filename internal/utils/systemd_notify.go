@@ -60,7 +60,7 @@ func StartWatchdogUpdates() {
 
 		for range ticker.C {
 			if err := NotifySystemd("WATCHDOG=1"); err != nil {
-				fmt.Printf("Warning: failed to send watchdog update: %v\n", err)
+				Warnf("Warning: failed to send watchdog update: %v", err)
 			}
 		}
 	}()
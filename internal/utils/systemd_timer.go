@@ -0,0 +1,286 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const oneshotTemplate = `[Unit]
+Description=Avolut Backup of set %%i
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s --set %%i
+WorkingDirectory=%s
+`
+
+const timerTemplate = `[Unit]
+Description=Avolut Backup schedule of set %s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+
+const systemdDir = "/etc/systemd/system"
+
+// unitInstance matches set names usable as systemd unit instances
+var unitInstance = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// InstallSystemdTimer installs a oneshot service run by a timer per backup
+// set instead of the always-on daemon. schedules maps set names to their cron
+// schedule, which are in the IANA time zone timezone or in local time when it
+// is empty.
+func InstallSystemdTimer(schedules map[string]string, timezone string) error {
+	if !IsSystemdAvailable() {
+		return fmt.Errorf("systemd is not available on this system")
+	}
+
+	// Translate every schedule before touching anything
+	calendars := map[string]string{}
+	for name, schedule := range schedules {
+		if !unitInstance.MatchString(name) {
+			return fmt.Errorf("set name %q can't be used in a systemd unit name", name)
+		}
+		calendar, err := CronToOnCalendar(schedule)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", name, err)
+		}
+		if timezone != "" {
+			calendar += " " + timezone
+		}
+		calendars[name] = calendar
+	}
+
+	// Get the absolute path of the current executable
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute executable path: %w", err)
+	}
+
+	// Get the current working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	// Replace the daemon and timers of an earlier installation
+	if err := RemoveSystemdService(); err != nil {
+		return err
+	}
+
+	// Write the service template and a timer per set
+	servicePath := filepath.Join(systemdDir, "avolut-backup@.service")
+	if err := os.WriteFile(servicePath, []byte(fmt.Sprintf(oneshotTemplate, exePath, wd)), 0644); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+	var timers []string
+	for name, calendar := range calendars {
+		timer := "avolut-backup@" + name + ".timer"
+		content := fmt.Sprintf(timerTemplate, name, calendar)
+		if err := os.WriteFile(filepath.Join(systemdDir, timer), []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write timer file: %w", err)
+		}
+		timers = append(timers, timer)
+	}
+
+	// Reload systemd daemon
+	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	// Enable and start the timers
+	if err := exec.Command("systemctl", append([]string{"enable", "--now"}, timers...)...).Run(); err != nil {
+		return fmt.Errorf("failed to enable and start timers: %w", err)
+	}
+
+	return nil
+}
+
+// removeSystemdTimers stops and removes the units installed by
+// InstallSystemdTimer, if any
+func removeSystemdTimers() error {
+	timers, _ := filepath.Glob(filepath.Join(systemdDir, "avolut-backup@*.timer"))
+	for _, path := range timers {
+		_ = exec.Command("systemctl", "disable", "--now", filepath.Base(path)).Run() // Ignore errors as the timer might not be running
+	}
+	for _, path := range append(timers, filepath.Join(systemdDir, "avolut-backup@.service")) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+var (
+	cronDescriptors = map[string]string{
+		"@yearly":   "*-01-01 00:00:00",
+		"@annually": "*-01-01 00:00:00",
+		"@monthly":  "*-*-01 00:00:00",
+		"@weekly":   "Sun *-*-* 00:00:00",
+		"@daily":    "*-*-* 00:00:00",
+		"@midnight": "*-*-* 00:00:00",
+		"@hourly":   "*-*-* *:00:00",
+	}
+	monthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	// calendarDays are the weekday names of systemd
+	calendarDays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+)
+
+// CronToOnCalendar translates a cron expression with five fields, or six
+// with leading seconds, into a systemd OnCalendar specification, e.g.
+// "30 2 * * 1-5" to "Mon,Tue,Wed,Thu,Fri *-*-* 02:30:00"
+func CronToOnCalendar(expr string) (string, error) {
+	expr = strings.TrimSpace(expr)
+	if calendar, ok := cronDescriptors[expr]; ok {
+		return calendar, nil
+	}
+	if strings.HasPrefix(expr, "@every") {
+		return "", fmt.Errorf("schedule %q runs at intervals from the start of the daemon, which systemd calendars can't express", expr)
+	}
+
+	fields := strings.Fields(expr)
+	seconds := []int{0}
+	if len(fields) == 6 {
+		var err error
+		if seconds, err = cronField(fields[0], 0, 59, nil); err != nil {
+			return "", err
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 5 {
+		return "", fmt.Errorf("schedule %q is not a cron expression with five or six fields", expr)
+	}
+
+	minutes, err := cronField(fields[0], 0, 59, nil)
+	if err != nil {
+		return "", err
+	}
+	hours, err := cronField(fields[1], 0, 23, nil)
+	if err != nil {
+		return "", err
+	}
+	days, err := cronField(fields[2], 1, 31, nil)
+	if err != nil {
+		return "", err
+	}
+	months, err := cronField(fields[3], 1, 12, monthNames)
+	if err != nil {
+		return "", err
+	}
+	weekdays, err := cronField(fields[4], 0, 7, dayNames)
+	if err != nil {
+		return "", err
+	}
+
+	// cron runs when either the day of month or the weekday matches, systemd
+	// only when both do
+	if days != nil && weekdays != nil {
+		return "", fmt.Errorf("schedule %q restricts both the day of month and the weekday, which systemd can't express", expr)
+	}
+
+	var weekday string
+	if weekdays != nil {
+		var names []string
+		for _, d := range weekdays {
+			// Both 0 and 7 are Sunday
+			if name := calendarDays[d%7]; !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		weekday = strings.Join(names, ",") + " "
+	}
+	return fmt.Sprintf("%s*-%s-%s %s:%s:%s", weekday,
+		calendarValues(months), calendarValues(days), calendarValues(hours), calendarValues(minutes), calendarValues(seconds)), nil
+}
+
+// cronField expands a cron field into its values, nil for "*". names are
+// accepted in place of the numbers they are indexed by.
+func cronField(field string, lo, hi int, names []string) ([]int, error) {
+	if field == "*" {
+		return nil, nil
+	}
+
+	value := func(s string) (int, error) {
+		if i := slices.Index(names, strings.ToLower(s)); i >= 0 && s != "" {
+			return i, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("invalid cron value %q", s)
+		}
+		return n, nil
+	}
+
+	var values []int
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid cron step %q", part)
+			}
+		}
+
+		from, to := lo, hi
+		switch start, end, isRange := strings.Cut(rangePart, "-"); {
+		case rangePart == "*":
+		case isRange:
+			var err error
+			if from, err = value(start); err != nil {
+				return nil, err
+			}
+			if to, err = value(end); err != nil {
+				return nil, err
+			}
+		default:
+			var err error
+			if from, err = value(rangePart); err != nil {
+				return nil, err
+			}
+			// A single value only covers the rest of the range with a step
+			if !hasStep {
+				to = from
+			}
+		}
+		if from > to {
+			return nil, fmt.Errorf("invalid cron range %q", part)
+		}
+		for v := from; v <= to; v += step {
+			if !slices.Contains(values, v) {
+				values = append(values, v)
+			}
+		}
+	}
+	slices.Sort(values)
+	return values, nil
+}
+
+// calendarValues formats values as a systemd calendar component
+func calendarValues(values []int) string {
+	if values == nil {
+		return "*"
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%02d", v)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,64 @@
+package utils
+
+import "testing"
+
+func TestCronToOnCalendar(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{"0 2 * * *", "*-*-* 02:00:00", false},
+		{"30 2 * * 1-5", "Mon,Tue,Wed,Thu,Fri *-*-* 02:30:00", false},
+		{"0 0 * * 0", "Sun *-*-* 00:00:00", false},
+		{"0 0 * * 7", "Sun *-*-* 00:00:00", false},
+		{"0 0 * * sat,sun", "Sun,Sat *-*-* 00:00:00", false},
+		{"*/15 * * * *", "*-*-* *:00,15,30,45:00", false},
+		{"0 */6 * * *", "*-*-* 00,06,12,18:00:00", false},
+		{"0 3 1 * *", "*-*-01 03:00:00", false},
+		{"0 3 1 jan,jul *", "*-01,07-01 03:00:00", false},
+		{"5/20 * * * *", "*-*-* *:05,25,45:00", false},
+		{"  0 2 * * *  ", "*-*-* 02:00:00", false},
+
+		// Six fields with leading seconds
+		{"30 0 2 * * *", "*-*-* 02:00:30", false},
+		{"*/20 * * * * *", "*-*-* *:*:00,20,40", false},
+		{"0 30 2 * * mon", "Mon *-*-* 02:30:00", false},
+
+		// Descriptors
+		{"@hourly", "*-*-* *:00:00", false},
+		{"@daily", "*-*-* 00:00:00", false},
+		{"@midnight", "*-*-* 00:00:00", false},
+		{"@weekly", "Sun *-*-* 00:00:00", false},
+		{"@monthly", "*-*-01 00:00:00", false},
+		{"@yearly", "*-01-01 00:00:00", false},
+		{"@annually", "*-01-01 00:00:00", false},
+
+		{"@every 1h", "", true},
+		{"@fortnightly", "", true},
+		{"", "", true},
+		{"0 2 * *", "", true},
+		{"0 0 0 2 * * *", "", true},
+		{"60 2 * * *", "", true},
+		{"0 24 * * *", "", true},
+		{"60 0 2 * * *", "", true},
+		{"0 2 0 * *", "", true},
+		{"0 2 * 13 *", "", true},
+		{"0 2 * * 8", "", true},
+		{"0 2 * * funday", "", true},
+		{"*/0 * * * *", "", true},
+		{"30-10 * * * *", "", true},
+		// Either the day of month or the weekday, systemd needs both to match
+		{"0 2 1 * mon", "", true},
+	}
+	for _, tt := range tests {
+		got, err := CronToOnCalendar(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CronToOnCalendar(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CronToOnCalendar(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
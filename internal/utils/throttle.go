@@ -2,12 +2,7 @@
 
 package utils
 
-// ThrottleCPU sets the process priority to reduce CPU usage
-func ThrottleCPU() error {
-	return nil
-}
-
-// SetProcessPriority sets the process priority for the current process
-func SetProcessPriority() error {
+// SetProcessPriority is a no-op on non-Linux systems
+func SetProcessPriority(niceness int, ioClass string, cpus []int) error {
 	return nil
 }
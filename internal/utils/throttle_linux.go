@@ -3,54 +3,69 @@
 package utils
 
 import (
-	"runtime"
-	"syscall"
+	"fmt"
+	"os"
+	"strconv"
 
 	"golang.org/x/sys/unix"
 )
 
-// ThrottleCPU sets the process priority to reduce CPU usage
-func ThrottleCPU() error {
-	if runtime.GOOS == "linux" {
-		// Get the current process
-		proc := syscall.Getpid()
+// I/O scheduling classes of ioprio_set
+const (
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+	ioprioClassShift      = 13
+	ioprioWhoProcess      = 1
+)
 
-		// Set nice value to 19 (lowest priority)
-		// This will reduce CPU usage significantly
-		if err := syscall.Setpriority(syscall.PRIO_PROCESS, proc, 19); err != nil {
-			return err
-		}
+// SetProcessPriority lowers the CPU and I/O priority of the process and
+// optionally pins it to the given CPUs. These settings are per thread on
+// Linux, so they are applied to every thread, and threads started later
+// inherit them.
+func SetProcessPriority(niceness int, ioClass string, cpus []int) error {
+	ioprio := -1
+	switch ioClass {
+	case "":
+	case "best-effort":
+		// Derive the level from the nice value like the kernel does
+		level := min(max((niceness+20)/5, 0), 7)
+		ioprio = ioprioClassBestEffort<<ioprioClassShift | level
+	case "idle":
+		ioprio = ioprioClassIdle << ioprioClassShift
+	default:
+		return fmt.Errorf("unknown I/O class %q, use idle or best-effort", ioClass)
 	}
 
-	return nil
-}
-
-// setLinuxCPUAffinity is a stub for non-Linux systems
-func setLinuxCPUAffinity() error {
-	// Create a CPU set with only one CPU enabled
-	// This helps reduce CPU usage by preventing the process from running on multiple cores
-	mask := unix.CPUSet{}
-	mask.Set(0) // Use only the first CPU
-
-	// Set CPU affinity for the current process
-	if err := unix.SchedSetaffinity(0, &mask); err != nil {
-		return err
+	// Pinning is opt-in, a single core slows down large backups
+	var mask *unix.CPUSet
+	if len(cpus) > 0 {
+		mask = &unix.CPUSet{}
+		for _, cpu := range cpus {
+			mask.Set(cpu)
+		}
 	}
 
-	return nil
-}
-
-// SetProcessPriority sets the process priority for the current process
-func SetProcessPriority() error {
-	// Set process priority
-	if err := ThrottleCPU(); err != nil {
-		return err
+	threads, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("listing threads: %w", err)
 	}
-
-	// CPU affinity is only supported on Linux
-	if runtime.GOOS == "linux" {
-		if err := setLinuxCPUAffinity(); err != nil {
-			return err
+	for _, thread := range threads {
+		tid, err := strconv.Atoi(thread.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, niceness); err != nil {
+			return fmt.Errorf("setting nice value: %w", err)
+		}
+		if ioprio >= 0 {
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+				return fmt.Errorf("setting I/O priority: %w", errno)
+			}
+		}
+		if mask != nil {
+			if err := unix.SchedSetaffinity(tid, mask); err != nil {
+				return fmt.Errorf("setting CPU affinity: %w", err)
+			}
 		}
 	}
 
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,11 +16,54 @@ var (
 )
 
 type BackupProgress struct {
-	TotalItems      int
-	CurrentItem     int
-	CurrentItemName string
+	TotalItems int
+	// StartedItems and CompletedItems differ while items run in parallel
+	StartedItems   int
+	CompletedItems int
+	FailedItems    int
+	// RunningItems holds the names of the items in progress
+	RunningItems []string
+	// Running holds the progress within each running item
+	Running         map[string]*ItemProgress
 	StartTime       time.Time
 	LastUpdateTime  time.Time
+	LastSummaryTime time.Time
+}
+
+// ItemProgress is the progress within a running item, updated while its files
+// are hashed and uploaded
+type ItemProgress struct {
+	// HashedBytes counts the bytes read, including unchanged files that were
+	// not read again
+	HashedBytes   atomic.Int64
+	UploadedBytes atomic.Int64
+	Files         atomic.Int64
+	// EstimatedBytes and EstimatedFiles are the size of the item, zero until
+	// it was estimated
+	EstimatedBytes atomic.Int64
+	EstimatedFiles atomic.Int64
+}
+
+// fraction returns the part of the item that is done, false if its size is
+// not known yet
+func (p *ItemProgress) fraction() (float64, bool) {
+	estimated := p.EstimatedBytes.Load()
+	if estimated <= 0 {
+		return 0, false
+	}
+	return min(float64(p.HashedBytes.Load())/float64(estimated), 1), true
+}
+
+func (p *ItemProgress) String() string {
+	hashed := formatBytes(p.HashedBytes.Load())
+	if estimated := p.EstimatedBytes.Load(); estimated > 0 {
+		hashed += " of " + formatBytes(estimated)
+	}
+	files := fmt.Sprintf("%d", p.Files.Load())
+	if estimated := p.EstimatedFiles.Load(); estimated > 0 {
+		files += fmt.Sprintf("/%d", estimated)
+	}
+	return fmt.Sprintf("%s read, %s uploaded, %s files", hashed, formatBytes(p.UploadedBytes.Load()), files)
 }
 
 func InitProgress(totalItems int) *BackupProgress {
@@ -26,14 +71,36 @@ func InitProgress(totalItems int) *BackupProgress {
 	defer progressMutex.Unlock()
 
 	currentProgress = &BackupProgress{
-		TotalItems:     totalItems,
-		StartTime:      time.Now(),
-		LastUpdateTime: time.Now(),
+		TotalItems:      totalItems,
+		Running:         map[string]*ItemProgress{},
+		StartTime:       time.Now(),
+		LastUpdateTime:  time.Now(),
+		LastSummaryTime: time.Now(),
 	}
 	return currentProgress
 }
 
-func UpdateProgress(itemName string) {
+// UpdateProgress marks an item as started and returns the tracker of its
+// progress
+func UpdateProgress(itemName string) *ItemProgress {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	item := &ItemProgress{}
+	if currentProgress == nil {
+		return item
+	}
+
+	currentProgress.StartedItems++
+	currentProgress.RunningItems = append(currentProgress.RunningItems, itemName)
+	currentProgress.Running[itemName] = item
+	currentProgress.LastUpdateTime = time.Now()
+	return item
+}
+
+// FinishProgress marks a started item as completed, counting it as failed
+// if requested
+func FinishProgress(itemName string, failed bool) {
 	progressMutex.Lock()
 	defer progressMutex.Unlock()
 
@@ -41,11 +108,41 @@ func UpdateProgress(itemName string) {
 		return
 	}
 
-	currentProgress.CurrentItem++
-	currentProgress.CurrentItemName = itemName
+	for i, name := range currentProgress.RunningItems {
+		if name == itemName {
+			currentProgress.RunningItems = append(currentProgress.RunningItems[:i], currentProgress.RunningItems[i+1:]...)
+			break
+		}
+	}
+	delete(currentProgress.Running, itemName)
+	currentProgress.CompletedItems++
+	if failed {
+		currentProgress.FailedItems++
+	}
 	currentProgress.LastUpdateTime = time.Now()
 }
 
+// ProgressSummaryDue reports whether a progress summary should be logged:
+// about every 5% of the items, at least once a minute and after the last item.
+// Every call that returns true starts a new interval.
+func ProgressSummaryDue() bool {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	if currentProgress == nil {
+		return false
+	}
+
+	step := max(currentProgress.TotalItems/20, 1)
+	due := currentProgress.CompletedItems%step == 0 ||
+		currentProgress.CompletedItems == currentProgress.TotalItems ||
+		time.Since(currentProgress.LastSummaryTime) >= time.Minute
+	if due {
+		currentProgress.LastSummaryTime = time.Now()
+	}
+	return due
+}
+
 func GetProgressStatus() string {
 	progressMutex.Lock()
 	defer progressMutex.Unlock()
@@ -54,23 +151,57 @@ func GetProgressStatus() string {
 		return "No backup in progress"
 	}
 
-	percentage := float64(currentProgress.CurrentItem) / float64(currentProgress.TotalItems) * 100
+	// Running items count with the part of their data that is done
+	done := float64(currentProgress.CompletedItems)
+	var running []string
+	for _, name := range currentProgress.RunningItems {
+		item := currentProgress.Running[name]
+		if item == nil {
+			running = append(running, name)
+			continue
+		}
+		if fraction, ok := item.fraction(); ok {
+			done += fraction
+		}
+		running = append(running, fmt.Sprintf("%s (%s)", name, item))
+	}
+
+	percentage := done / float64(currentProgress.TotalItems) * 100
 	elapsed := time.Since(currentProgress.StartTime)
 	estimatedTotal := time.Duration(0)
-	if currentProgress.CurrentItem > 0 {
-		estimatedTotal = time.Duration(float64(elapsed) / float64(currentProgress.CurrentItem) * float64(currentProgress.TotalItems))
+	if done > 0 {
+		estimatedTotal = time.Duration(float64(elapsed) / done * float64(currentProgress.TotalItems))
 	}
 	estimatedRemaining := estimatedTotal - elapsed
 
-	return fmt.Sprintf("%.1f%% (%d/%d) | %s | Elapsed: %s | Remaining: ~%s",
+	runningStatus := "idle"
+	if len(running) > 0 {
+		runningStatus = strings.Join(running, ", ")
+	}
+
+	return fmt.Sprintf("%.1f%% (%d/%d, %d failed) | %s | Elapsed: %s | Remaining: ~%s",
 		percentage,
-		currentProgress.CurrentItem,
+		currentProgress.CompletedItems,
 		currentProgress.TotalItems,
-		currentProgress.CurrentItemName,
+		currentProgress.FailedItems,
+		runningStatus,
 		formatDuration(elapsed),
 		formatDuration(estimatedRemaining))
 }
 
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func formatDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	h := d / time.Hour
@@ -87,19 +218,33 @@ func formatDuration(d time.Duration) string {
 	return fmt.Sprintf("%ds", s)
 }
 
-// TryLock attempts to acquire the backup lock
+// LockFile is locked while a backup, prune or repair runs, so a manual run
+// can't race the daemon
+const LockFile = ".avolut/backup.lock"
+
+// TryLock attempts to acquire the backup lock, both within this process and
+// across processes. It returns false if the lock is held elsewhere.
 func TryLock() (bool, error) {
 	backupLock.Lock()
+	defer backupLock.Unlock()
 	if isBackupRunning {
-		backupLock.Unlock()
 		return false, nil
 	}
+
+	locked, err := tryFileLock(LockFile)
+	if err != nil || !locked {
+		return false, err
+	}
 	isBackupRunning = true
 	return true, nil
 }
 
 // Unlock releases the backup lock
 func Unlock() {
-	isBackupRunning = false
-	backupLock.Unlock()
+	backupLock.Lock()
+	defer backupLock.Unlock()
+	if isBackupRunning {
+		releaseFileLock()
+		isBackupRunning = false
+	}
 }